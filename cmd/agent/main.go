@@ -3,22 +3,21 @@ package main
 import (
 	"github.com/Osselnet/metrics-collector/internal/agent"
 	"github.com/Osselnet/metrics-collector/internal/agent/config"
+	"github.com/Osselnet/metrics-collector/internal/agent/queue"
 	"log"
+	"strings"
 	"time"
 )
 
 func main() {
-	config, err := config.ParseConfig()
+	conf, err := config.ParseConfig()
 	if err != nil {
-		log.Println("Error -", err)
+		log.Fatal(err)
 	}
 
-	cfg := agent.Config{
-		Timeout:        4 * time.Second,
-		PollInterval:   time.Duration(config.PollInterval) * time.Second,
-		ReportInterval: time.Duration(config.ReportInterval) * time.Second,
-		Address:        config.Addr,
-		Key:            config.Key,
+	cfg, err := agentConfig(conf)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	agent, err := agent.New(cfg)
@@ -26,5 +25,102 @@ func main() {
 		log.Fatal(err)
 	}
 
+	agent.WithReload(reload)
 	agent.Run()
 }
+
+func reload() (agent.Config, error) {
+	conf, err := config.Reload()
+	if err != nil {
+		return agent.Config{}, err
+	}
+	return agentConfig(conf)
+}
+
+func agentConfig(conf config.Config) (agent.Config, error) {
+	c, err := collectors(conf)
+	if err != nil {
+		return agent.Config{}, err
+	}
+
+	return agent.Config{
+		Timeout:        4 * time.Second,
+		PollInterval:   time.Duration(conf.PollInterval) * time.Second,
+		ReportInterval: time.Duration(conf.ReportInterval) * time.Second,
+		Addresses:      strings.Split(conf.Addr, ","),
+		Strategy:       conf.Strategy,
+		ID:             conf.ID,
+		Group:          conf.Group,
+		ConfigInterval: time.Duration(conf.ConfigInterval) * time.Second,
+		Key:            conf.Key,
+		RateLimit:      conf.RateLimit,
+		Processes:      c.Processes,
+		Cgroups:        c.Cgroups,
+		Commands:       c.Commands,
+		CommandTimeout: time.Duration(conf.CommandTimeout) * time.Second,
+		ScrapeTargets:  c.ScrapeTargets,
+		Probes:         c.Probes,
+		Queue: queue.Config{
+			Dir:     conf.QueueDir,
+			MaxSize: conf.QueueMaxSize,
+			MaxAge:  time.Duration(conf.QueueMaxAge) * time.Second,
+		},
+		Aggregation:       conf.Aggregation,
+		GaugeAggregations: c.GaugeAggregations,
+		ShutdownTimeout:   time.Duration(conf.ShutdownTimeout) * time.Second,
+	}, nil
+}
+
+// collectors returns the collector settings of the config file, or the
+// ones of a flag or env var where it's set.
+func collectors(conf config.Config) (agent.Config, error) {
+	var c agent.Config
+	var err error
+
+	for _, p := range conf.ProcessList {
+		c.Processes = append(c.Processes, agent.ProcessConfig{Label: p.Label, Match: p.Match, Pattern: p.Pattern})
+	}
+	if conf.Processes != "" {
+		if c.Processes, err = agent.ParseProcesses(conf.Processes); err != nil {
+			return c, err
+		}
+	}
+
+	c.Cgroups = conf.CgroupList
+	if conf.Cgroups != "" {
+		c.Cgroups = strings.Split(conf.Cgroups, ",")
+	}
+
+	c.Commands = conf.CommandList
+	if conf.Commands != "" {
+		if c.Commands, err = agent.ParseCommands(conf.Commands); err != nil {
+			return c, err
+		}
+	}
+
+	for _, t := range conf.ScrapeTargetList {
+		c.ScrapeTargets = append(c.ScrapeTargets, agent.ScrapeTarget{Label: t.Label, URL: t.URL})
+	}
+	if conf.ScrapeTargets != "" {
+		c.ScrapeTargets = agent.ParseScrapeTargets(conf.ScrapeTargets)
+	}
+
+	for _, p := range conf.ProbeList {
+		c.Probes = append(c.Probes, agent.Probe{Label: p.Label, Kind: p.Kind, Target: p.Target})
+	}
+	if conf.Probes != "" {
+		if c.Probes, err = agent.ParseProbes(conf.Probes); err != nil {
+			return c, err
+		}
+	}
+
+	for _, r := range conf.AggregateRuleList {
+		c.GaugeAggregations = append(c.GaugeAggregations, agent.GaugeAggregation{Pattern: r.Pattern, Mode: r.Mode})
+	}
+	if conf.AggregateRules != "" {
+		if c.GaugeAggregations, err = agent.ParseGaugeAggregations(conf.AggregateRules); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
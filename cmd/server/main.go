@@ -5,7 +5,9 @@ import (
 	"github.com/Osselnet/metrics-collector/internal/server/config"
 	"github.com/Osselnet/metrics-collector/internal/server/db"
 	"github.com/Osselnet/metrics-collector/internal/server/handlers"
+	"github.com/Osselnet/metrics-collector/internal/server/middleware/logger"
 	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
 	"github.com/go-chi/chi/v5"
 	"log"
 	"net/http"
@@ -15,29 +17,78 @@ import (
 	"time"
 )
 
+// expiryInterval is how often metrics past the retention are removed.
+const expiryInterval = time.Minute
+
 func main() {
 	cfg, err := config.ParseConfig()
 	if err != nil {
 		panic(err)
 	}
 
-	var dbStorage db.DateBaseStorage
+	if err := logger.SetLevel(cfg.LogLevel); err != nil {
+		panic(err)
+	}
 
-	if cfg.DSN != "" {
+	var dbStorage db.DateBaseStorage
+	if cfg.Backend() == config.StorageDatabase {
 		dbStorage = db.New(cfg.DSN)
 	}
 
-	h := handlers.New(chi.NewRouter(), dbStorage, cfg.Filename, cfg.Restore, cfg.Key)
+	var fileStorage *storage.FileStorage
+	if cfg.Backend() == config.StorageFile {
+		fileStorage, err = storage.OpenFile(cfg.Filename, cfg.Restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	h := handlers.New(chi.NewRouter(), dbStorage, "", false, "")
+	if fileStorage != nil {
+		h.WithStorage(fileStorage)
+	}
+	h.WithKeys(cfg.SignKeys()...)
+	h.WithExpiry(time.Duration(cfg.StaleAfter)*time.Second, time.Duration(cfg.Retention)*time.Second)
+	h.WithAdminToken(cfg.AdminToken)
+	h.WithRules(rules(cfg))
+	if cfg.AgentConfig != "" {
+		agentConfig, err := agentconfig.Load(cfg.AgentConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h.WithAgentConfig(agentConfig)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		current := cfg
+		for range hup {
+			current = reload(h, current)
+		}
+	}()
+
 	server := http.Server{
 		Addr:    cfg.Address,
 		Handler: h.GetRouter(),
 	}
 
 	go func() {
-		if cfg.DSN == "" && cfg.Filename != "" {
+		if fileStorage != nil {
 			for {
 				time.Sleep(time.Second * time.Duration(cfg.Interval))
-				h.Storage.(*storage.MemStorage).WriteDataToFile(cfg.Filename)
+				if err := fileStorage.Snapshot(); err != nil {
+					log.Printf("Could not save metrics to file: %v", err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(expiryInterval)
+			if err := h.Expire(context.Background()); err != nil {
+				log.Printf("Could not remove expired metrics: %v", err)
 			}
 		}
 	}()
@@ -49,8 +100,8 @@ func main() {
 		<-sigint
 		log.Println("Shutting down server")
 
-		if cfg.DSN == "" && cfg.Filename != "" {
-			if err := h.Storage.(*storage.MemStorage).WriteDataToFile(cfg.Filename); err != nil {
+		if fileStorage != nil {
+			if err := fileStorage.Close(); err != nil {
 				log.Printf("Error during saving data to file: %v", err)
 			}
 		}
@@ -73,3 +124,46 @@ func main() {
 		panic(err)
 	}
 }
+
+// reload applies the reloadable settings: keys, rules, admin token, agent
+// settings, expiry and log level. The rest needs a restart.
+func reload(h *handlers.Handler, cfg config.Config) config.Config {
+	next, err := config.Reload()
+	if err != nil {
+		log.Printf("Config is not reloaded: %v", err)
+		return cfg
+	}
+
+	var agentConfig *agentconfig.File
+	if next.AgentConfig != "" {
+		agentConfig, err = agentconfig.Load(next.AgentConfig)
+		if err != nil {
+			log.Printf("Config is not reloaded: %v", err)
+			return cfg
+		}
+	}
+
+	if err := logger.SetLevel(next.LogLevel); err != nil {
+		log.Printf("Config is not reloaded: %v", err)
+		return cfg
+	}
+	h.WithKeys(next.SignKeys()...)
+	h.WithAgentConfig(agentConfig)
+	h.WithExpiry(time.Duration(next.StaleAfter)*time.Second, time.Duration(next.Retention)*time.Second)
+	h.WithAdminToken(next.AdminToken)
+	h.WithRules(rules(next))
+
+	if cfg.NeedsRestart(next) {
+		log.Println("Address and storage changes take effect after restart")
+	}
+	log.Println("Config reloaded")
+	return next
+}
+
+func rules(cfg config.Config) []handlers.Rule {
+	rules := make([]handlers.Rule, 0, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rules = append(rules, handlers.Rule{Match: r.Match, Drop: r.Action == config.RuleDrop})
+	}
+	return rules
+}
@@ -6,7 +6,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/agent/queue"
 	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/go-resty/resty/v2"
 	"github.com/shirou/gopsutil/cpu"
@@ -28,14 +30,55 @@ type Config struct {
 	PollInterval   time.Duration
 	ReportInterval time.Duration
 	Address        string
+	Addresses      []string
+	Strategy       string
+	ID             string
+	Group          string
+	ConfigInterval time.Duration
 	Key            string
 	RateLimit      int
+	Processes      []ProcessConfig
+	Cgroups        []string
+	Commands       [][]string
+	CommandTimeout time.Duration
+	ScrapeTargets  []ScrapeTarget
+	Probes         []Probe
+	Queue          queue.Config
+
+	Aggregation       string
+	GaugeAggregations []GaugeAggregation
+	ShutdownTimeout   time.Duration
 }
 
 type Agent struct {
 	*metrics.Metrics
 	storage storage.Repositories
 	client  *resty.Client
+
+	mu           sync.Mutex
+	lastCounters map[metrics.Name]uint64
+	lastTotals   map[metrics.Name]total
+	processes    []*processWatch
+	cgroups      []cgroupWatch
+	queue        *queue.Queue
+	aggregator   *aggregator
+	telemetry    *telemetry
+	next         uint32
+	supervisor   *supervisor
+
+	routeMu sync.RWMutex
+	route   *route
+
+	endpointQueuesMu sync.Mutex
+	endpointQueues   map[string]*queue.Queue
+
+	applyMu       sync.Mutex
+	settings      agentconfig.Settings
+	settingsMu    sync.Mutex
+	pollEvery     time.Duration
+	reportEvery   time.Duration
+	reportEveryCh chan time.Duration
+	reloadFn      func() (Config, error)
 }
 
 type Metrics struct {
@@ -44,58 +87,164 @@ type Metrics struct {
 	Delta metrics.Counter `json:"delta"`          // значение метрики в случае передачи counter
 	Value metrics.Gauge   `json:"value"`          // значение метрики в случае передачи gauge
 	Hash  string          `json:"hash,omitempty"` // значение хеш-функции
+	Unit  string          `json:"unit,omitempty"` // единица измерения
+	Help  string          `json:"help,omitempty"` // описание метрики
 }
 
-type Sender func(context.Context, <-chan metrics.Metrics) error
+type Sender func(context.Context, metrics.Metrics) error
 
 var config Config
 
-func New(cfg Config) (*Agent, error) {
+const defaultShutdownTimeout = 10 * time.Second
+
+func (cfg *Config) validate() error {
 	if cfg.Timeout == 0 {
-		return nil, fmt.Errorf("you need to ask TimeoutTimeout")
+		return fmt.Errorf("you need to ask TimeoutTimeout")
 	}
 	if cfg.PollInterval == 0 {
-		return nil, fmt.Errorf("you need to ask PollInterval")
+		return fmt.Errorf("you need to ask PollInterval")
 	}
 	if cfg.ReportInterval == 0 {
-		return nil, fmt.Errorf("you need to ask ReportInterval")
+		return fmt.Errorf("you need to ask ReportInterval")
+	}
+	if cfg.Address == "" && len(cfg.Addresses) == 0 {
+		return fmt.Errorf("you need to ask server address")
+	}
+	if len(cfg.Addresses) == 0 {
+		cfg.Addresses = []string{cfg.Address}
 	}
 	if cfg.Address == "" {
-		return nil, fmt.Errorf("you need to ask server address")
+		cfg.Address = cfg.Addresses[0]
+	}
+	if cfg.ID == "" {
+		cfg.ID, _ = os.Hostname()
+	}
+	for _, p := range cfg.Probes {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validCommands(cfg.Commands); err != nil {
+		return err
+	}
+	for i, t := range cfg.ScrapeTargets {
+		if t.URL == "" {
+			return fmt.Errorf("scrape target %d has no url", i)
+		}
+		if t.Label == "" {
+			cfg.ScrapeTargets[i].Label = defaultScrapeLabel(t.URL)
+		}
+	}
+	return nil
+}
+
+func New(cfg Config) (*Agent, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	r, err := newRoute(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	config = cfg
 
 	a := &Agent{
-		Metrics: metrics.New(),
-		storage: storage.New(),
-		client:  resty.New(),
+		Metrics:      metrics.New(),
+		storage:      storage.New(),
+		client:       resty.New(),
+		lastCounters: make(map[metrics.Name]uint64),
+		lastTotals:   make(map[metrics.Name]total),
+		route:        r,
+		telemetry:    newTelemetry(),
+
+		pollEvery:     cfg.PollInterval,
+		reportEvery:   cfg.ReportInterval,
+		reportEveryCh: make(chan time.Duration, 1),
 	}
 	a.client.SetTimeout(cfg.Timeout)
 
+	a.processes, err = newProcessWatches(cfg.Processes)
+	if err != nil {
+		return nil, err
+	}
+
+	a.cgroups, err = newCgroupWatches(cgroupRoot, cfg.Cgroups)
+	if err != nil {
+		return nil, err
+	}
+
+	a.aggregator, err = newAggregator(cfg.Aggregation, cfg.GaugeAggregations)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Queue.Dir != "" {
+		a.queue, err = queue.New(cfg.Queue)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return a, nil
 }
 
 func (a *Agent) Run() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	a.run(c)
+}
+
+func (a *Agent) run(stop <-chan os.Signal) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	metricsCh := make(chan metrics.Metrics, config.RateLimit)
-	defer close(metricsCh)
 
-	go a.RunPool(ctx, metricsCh)
-	go a.GopsutilTicker(ctx, metricsCh)
-	go a.RunReport(ctx, metricsCh)
+	a.supervisor = newSupervisor(ctx, metricsCh)
+	for name, c := range a.collectors() {
+		a.supervisor.Start(name, c)
+	}
+	if config.ConfigInterval > 0 {
+		a.supervisor.Start(configTask, a.configTicker)
+	}
+
+	// Senders don't share ctx with the collectors, so batches handed to them
+	// are still delivered after the shutdown signal, until the deadline.
+	sendCtx, sendCancel := context.WithCancel(context.Background())
+	defer sendCancel()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	sig := <-c
+	jobs := make(chan metrics.Metrics, config.RateLimit)
+	senders := a.RunSenders(sendCtx, jobs)
+	go a.RunReport(metricsCh, jobs)
+
+	sig := <-stop
+	for sig == syscall.SIGHUP {
+		a.reload()
+		sig = <-stop
+	}
 	log.Println("Shutdown signal received:", sig)
+
+	timeout := config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.AfterFunc(timeout, sendCancel)
+	defer deadline.Stop()
+
+	// metricsCh is closed only when no collector can write to it any more,
+	// then RunReport merges what is left and hands over the final batch.
+	cancel()
+	a.supervisor.Wait()
+	close(metricsCh)
+
+	senders.Wait()
 	log.Println("Agent work completed")
 }
 
 func (a *Agent) RunPool(ctx context.Context, metricsCh chan<- metrics.Metrics) {
-	ticker := time.NewTicker(config.PollInterval)
+	ticker := time.NewTicker(a.pollInterval())
 	for {
 		select {
 		case <-ticker.C:
@@ -108,48 +257,82 @@ func (a *Agent) RunPool(ctx context.Context, metricsCh chan<- metrics.Metrics) {
 	}
 }
 
-func Retry(sender Sender, retries int, delay time.Duration) Sender {
-	return func(ctx context.Context, metricsCh <-chan metrics.Metrics) error {
-		for r := 0; ; r++ {
-			err := sender(ctx, metricsCh)
-			if err == nil || r >= retries {
-				return err
-			}
+// RunReport aggregates every snapshot the collectors produce during a report
+// interval and hands the result to the senders once per interval, together
+// with the agent telemetry. When all senders are busy the batch is kept aside
+// and merged into the next one. Once metricsCh is closed the rest is sent as
+// a final batch and jobs is closed.
+func (a *Agent) RunReport(metricsCh <-chan metrics.Metrics, jobs chan<- metrics.Metrics) {
+	ticker := time.NewTicker(config.ReportInterval)
+	defer ticker.Stop()
+	defer close(jobs)
+
+	var postponed *metrics.Metrics
+	batch := func() metrics.Metrics {
+		prm := a.aggregator.Flush()
+		if postponed == nil {
+			return prm
+		}
+		postponed.Merge(prm)
+		prm, postponed = *postponed, nil
+		return prm
+	}
 
-			log.Printf("Function call failed, retrying in %v", delay)
+	for {
+		select {
+		case prm, ok := <-metricsCh:
+			if !ok {
+				a.aggregator.Add(a.telemetry.Snapshot(0))
+				jobs <- batch()
+				log.Println("Regular shutdown of sending metrics")
+				return
+			}
+			a.aggregator.Add(prm)
 
-			delay = delay + time.Second*2
+		case d := <-a.reportEveryCh:
+			ticker.Reset(d)
 
+		case <-ticker.C:
+			a.aggregator.Add(a.telemetry.Snapshot(len(metricsCh)))
+			prm := batch()
 			select {
-			case <-time.After(delay):
-			case <-ctx.Done():
-				return ctx.Err()
+			case jobs <- prm:
+			default:
+				log.Println("All senders are busy, report postponed")
+				postponed = &prm
 			}
 		}
 	}
 }
 
-func (a *Agent) RunReport(ctx context.Context, metricsCh <-chan metrics.Metrics) {
-	ticker := time.NewTicker(config.ReportInterval)
-	for {
-		select {
-		case <-ticker.C:
-			fn := Retry(a.sendReportUpdates, 3, 1*time.Second)
-			err := fn(ctx, metricsCh)
-			if err != nil {
-				log.Println(err)
-			}
+// RunSenders starts config.RateLimit workers sending batches from jobs, each
+// batch with its own retries. Workers exit once jobs is closed and drained.
+// Batches that can't be sent or queued before ctx is done are reported as
+// lost.
+func (a *Agent) RunSenders(ctx context.Context, jobs <-chan metrics.Metrics) *sync.WaitGroup {
+	workers := config.RateLimit
+	if workers < 1 {
+		workers = 1
+	}
 
-		case <-ctx.Done():
-			log.Println("Regular shutdown of sending metrics")
-			ticker.Stop()
-			return
-		}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prm := range jobs {
+				err := a.report(ctx, prm)
+				if err != nil && ctx.Err() != nil && a.queue == nil {
+					log.Printf("Shutdown deadline exceeded, lost %d gauges and %d counters", len(prm.Gauges), len(prm.Counters))
+				}
+			}
+		}()
 	}
+	return &wg
 }
 
 func (a *Agent) GopsutilTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
-	ticker := time.NewTicker(config.PollInterval)
+	ticker := time.NewTicker(a.pollInterval())
 	for {
 		select {
 		case <-ticker.C:
@@ -162,38 +345,89 @@ func (a *Agent) GopsutilTicker(ctx context.Context, metricsCh chan<- metrics.Met
 	}
 }
 
-func (a *Agent) sendReportUpdates(ctx context.Context, metricsCh <-chan metrics.Metrics) error {
+func (a *Agent) report(ctx context.Context, prm metrics.Metrics) error {
+	if len(prm.Gauges) == 0 && len(prm.Counters) == 0 {
+		return nil
+	}
+
+	// Queued batches are merged under the fresh one, so the server gets the
+	// queued counter increments and the current gauge values.
+	batch := prm
+	var segments []uint64
+	if a.queue != nil && a.queue.Len() > 0 {
+		queued, s, err := a.queue.Drain()
+		if err != nil {
+			a.handleError(fmt.Errorf("could not read queued metrics - %w", err))
+		} else {
+			queued.Merge(prm)
+			batch = queued
+			segments = s
+		}
+	}
+
+	err := a.send(ctx, batch)
+	if err != nil {
+		log.Println(err)
+		a.telemetry.add(metrics.AgentBatchesFailed, 1)
+		if a.queue == nil {
+			a.telemetry.add(metrics.AgentBatchesLost, 1)
+			return err
+		}
+		a.queue.Release(segments)
+		if err := a.queue.Push(prm); err != nil {
+			a.handleError(fmt.Errorf("could not queue unsent metrics - %w", err))
+			a.telemetry.add(metrics.AgentBatchesLost, 1)
+		}
+		return err
+	}
+	a.telemetry.add(metrics.AgentBatchesSent, 1)
+
+	if len(segments) > 0 {
+		if err := a.queue.Remove(segments); err != nil {
+			a.handleError(err)
+			return nil
+		}
+		log.Printf("Queued metrics sent from %d segments", len(segments))
+	}
+	return nil
+}
+
+func (a *Agent) sendReportUpdates(ctx context.Context, r *route, address string, prm metrics.Metrics) error {
 	hm := make([]Metrics, 0, metrics.GaugeLen+metrics.CounterLen)
 	var hash = ""
 
-	prm := <-metricsCh
-
 	for k, v := range prm.Gauges {
 		value := float64(v)
 
-		if config.Key != "" {
-			hash = metrics.GaugeHash(config.Key, string(k), value)
+		if r.key != "" {
+			hash = metrics.GaugeHash(r.key, string(k), value)
 		}
 
+		meta, _ := metrics.Describe(k)
 		hm = append(hm, Metrics{
 			ID:    string(k),
 			MType: metrics.TypeGauge,
 			Value: metrics.Gauge(value),
 			Hash:  hash,
+			Unit:  meta.Unit,
+			Help:  meta.Help,
 		})
 	}
 
 	for k, v := range prm.Counters {
 		delta := int64(v)
 
-		if config.Key != "" {
-			hash = metrics.CounterHash(config.Key, string(k), delta)
+		if r.key != "" {
+			hash = metrics.CounterHash(r.key, string(k), delta)
 		}
+		meta, _ := metrics.Describe(k)
 		hm = append(hm, Metrics{
 			ID:    string(k),
 			MType: metrics.TypeCounter,
 			Delta: metrics.Counter(delta),
 			Hash:  hash,
+			Unit:  meta.Unit,
+			Help:  meta.Help,
 		})
 	}
 
@@ -201,33 +435,48 @@ func (a *Agent) sendReportUpdates(ctx context.Context, metricsCh <-chan metrics.
 		return fmt.Errorf("%s", "Empty array of metrics, nothing to send")
 	}
 
-	_, err := a.sendUpdates(ctx, hm)
+	_, err := a.sendUpdates(ctx, address, r.id, hm)
 	if err != nil {
 		a.handleError(err)
 		return err
 	}
 
-	log.Println("Report sent")
+	log.Println("Report sent to", address)
 	return nil
 }
 
-func (a *Agent) sendUpdates(ctx context.Context, hm []Metrics) (*resty.Response, error) {
-	var endpoint = fmt.Sprintf("http://%s/updates/", config.Address)
+// sendUpdates posts hm to the server, the agent id lets the server tell
+// which agents are down.
+func (a *Agent) sendUpdates(ctx context.Context, address, id string, hm []Metrics) (*resty.Response, error) {
+	var endpoint = fmt.Sprintf("http://%s/updates/", address)
+
+	data, err := json.Marshal(hm)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := Compress(data)
+	if err != nil {
+		return nil, err
+	}
 
+	start := time.Now()
 	resp, err := a.client.R().
 		SetHeader("Accept", "application/json").
 		SetHeader("Accept-Encoding", "gzip").
 		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip").
+		SetHeader("X-Agent-ID", id).
 		SetContext(ctx).
-		SetBody(hm).
+		SetBody(compressed).
 		Post(endpoint)
 
 	if err != nil {
 		return nil, err
 	}
+	a.telemetry.request(len(data), len(compressed), time.Since(start))
 
 	if resp.StatusCode() != http.StatusOK {
-		return resp, fmt.Errorf("invalid status code %v", resp.StatusCode())
+		return resp, newStatusError(resp.StatusCode(), resp.Header().Get("Retry-After"))
 	}
 
 	return resp, nil
@@ -380,6 +629,13 @@ func (a *Agent) gopsutilUpdate(metricsCh chan<- metrics.Metrics) {
 	gauges[metrics.TotalMemory] = metrics.Gauge(v.Total)
 	gauges[metrics.FreeMemory] = metrics.Gauge(v.Free)
 
+	a.swapUpdate(gauges)
+	a.loadUpdate(gauges)
+	a.uptimeUpdate(gauges)
+	a.diskUsageUpdate(gauges)
+	a.diskIOUpdate(prm.Counters)
+	a.netIOUpdate(prm.Counters)
+
 	prm.Gauges = gauges
 	mu.Unlock()
 
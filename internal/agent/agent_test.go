@@ -1,13 +1,19 @@
 package agent
 
 import (
+	"context"
+	"github.com/Osselnet/metrics-collector/internal/agent/queue"
 	"github.com/Osselnet/metrics-collector/internal/server/handlers"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -79,3 +85,353 @@ func TestAgent_sendReport(t *testing.T) {
 		})
 	}
 }
+
+func TestAgent_reportQueue(t *testing.T) {
+	h := handlers.New(chi.NewRouter(), nil, "", false, "")
+	server := httptest.NewUnstartedServer(h.GetRouter())
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        server.Listener.Addr().String(),
+		Queue:          queue.Config{Dir: t.TempDir()},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.report(ctx, metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{metrics.Alloc: 1},
+		Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 2},
+	})
+	a.report(ctx, metrics.Metrics{})
+	assert.Equal(t, 1, a.queue.Len())
+
+	server.Start()
+	defer server.Close()
+
+	a.report(context.Background(), metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{metrics.Alloc: 5},
+		Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1},
+	})
+	assert.Equal(t, 0, a.queue.Len())
+
+	alloc, err := h.Storage.Get(context.Background(), string(metrics.Alloc))
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(5), alloc)
+
+	pollCount, err := h.Storage.Get(context.Background(), string(metrics.PollCount))
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(3), pollCount)
+}
+
+func TestAgent_reportQueueConcurrently(t *testing.T) {
+	const (
+		queued  = 20
+		workers = 8
+	)
+	h := handlers.New(chi.NewRouter(), nil, "", false, "")
+	server := httptest.NewServer(h.GetRouter())
+	defer server.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        strings.TrimPrefix(server.URL, "http://"),
+		Queue:          queue.Config{Dir: t.TempDir(), SegmentSize: 64},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < queued; i++ {
+		require.NoError(t, a.queue.Push(metrics.Metrics{
+			Counters: map[metrics.Name]metrics.Counter{"Queued": 1},
+		}))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, a.report(context.Background(), metrics.Metrics{
+				Counters: map[metrics.Name]metrics.Counter{"Fresh": 1},
+			}))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, a.queue.Len())
+	got, err := h.Storage.Get(context.Background(), "Queued")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(queued), got)
+	got, err = h.Storage.Get(context.Background(), "Fresh")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(workers), got)
+}
+
+func TestAgent_RunReportMergesSnapshots(t *testing.T) {
+	// MemStorage is read here while the server writes to it.
+	var mu sync.Mutex
+	h := handlers.New(chi.NewRouter(), nil, "", false, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		h.GetRouter().ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	get := func(name metrics.Name) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return h.Storage.Get(context.Background(), string(name))
+	}
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: 200 * time.Millisecond,
+		Address:        strings.TrimPrefix(server.URL, "http://"),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metricsCh := make(chan metrics.Metrics)
+	defer close(metricsCh)
+	jobs := make(chan metrics.Metrics, 1)
+	a.RunSenders(ctx, jobs)
+	go a.RunReport(metricsCh, jobs)
+
+	for i := 1; i <= 3; i++ {
+		metricsCh <- metrics.Metrics{
+			Gauges:   map[metrics.Name]metrics.Gauge{metrics.Alloc: metrics.Gauge(i)},
+			Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1},
+		}
+	}
+	metricsCh <- metrics.Metrics{Gauges: map[metrics.Name]metrics.Gauge{metrics.Load1: 0.5}}
+
+	require.Eventually(t, func() bool {
+		pollCount, err := get(metrics.PollCount)
+		return err == nil && pollCount == metrics.Counter(3)
+	}, 2*time.Second, 50*time.Millisecond)
+
+	alloc, err := get(metrics.Alloc)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(3), alloc)
+
+	load, err := get(metrics.Load1)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(0.5), load)
+}
+
+func TestAgent_RunReportPostponed(t *testing.T) {
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: 200 * time.Millisecond,
+		Address:        "127.0.0.1:8080",
+		Aggregation:    AggregateAvg,
+	})
+	require.NoError(t, err)
+
+	metricsCh := make(chan metrics.Metrics)
+	jobs := make(chan metrics.Metrics)
+	go a.RunReport(metricsCh, jobs)
+
+	// Nobody takes the first batch, it's merged into the next one rather
+	// than averaged with its samples.
+	metricsCh <- metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{"Queue": 10},
+		Counters: map[metrics.Name]metrics.Counter{"Jobs": 1},
+	}
+	time.Sleep(300 * time.Millisecond)
+	metricsCh <- metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{"Queue": 20},
+		Counters: map[metrics.Name]metrics.Counter{"Jobs": 2},
+	}
+	metricsCh <- metrics.Metrics{Gauges: map[metrics.Name]metrics.Gauge{"Queue": 30}}
+
+	prm := <-jobs
+	assert.Equal(t, metrics.Gauge(25), prm.Gauges["Queue"])
+	assert.Equal(t, metrics.Counter(3), prm.Counters["Jobs"])
+
+	close(metricsCh)
+	for range jobs {
+	}
+}
+
+func TestAgent_RunSenders(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak, received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(200 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		received++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        strings.TrimPrefix(server.URL, "http://"),
+		RateLimit:      3,
+	})
+	require.NoError(t, err)
+
+	jobs := make(chan metrics.Metrics, 6)
+	senders := a.RunSenders(context.Background(), jobs)
+	for i := 0; i < 6; i++ {
+		jobs <- metrics.Metrics{Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1}}
+	}
+	close(jobs)
+	senders.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 6, received)
+	assert.Equal(t, 3, peak)
+}
+
+func TestAgent_runFinalFlush(t *testing.T) {
+	var mu sync.Mutex
+	h := handlers.New(chi.NewRouter(), nil, "", false, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		h.GetRouter().ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   50 * time.Millisecond,
+		ReportInterval: time.Hour,
+		Address:        strings.TrimPrefix(server.URL, "http://"),
+		RateLimit:      1,
+	})
+	require.NoError(t, err)
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		a.run(stop)
+		close(done)
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	stop <- syscall.SIGTERM
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	pollCount, err := h.Storage.Get(context.Background(), string(metrics.PollCount))
+	require.NoError(t, err)
+	assert.Greater(t, pollCount, metrics.Counter(0))
+}
+
+func TestAgent_runShutdownDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	a, err := New(Config{
+		Timeout:         time.Second,
+		PollInterval:    50 * time.Millisecond,
+		ReportInterval:  time.Hour,
+		Address:         strings.TrimPrefix(server.URL, "http://"),
+		ShutdownTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		a.run(stop)
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	stop <- syscall.SIGTERM
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown deadline was not respected")
+	}
+}
+
+func TestNew_collectors(t *testing.T) {
+	base := Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "localhost:8080",
+	}
+	tests := []struct {
+		name    string
+		set     func(cfg *Config)
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			set: func(cfg *Config) {
+				cfg.Probes = []Probe{{Label: "db", Kind: ProbeTCP, Target: "localhost:5432"}}
+				cfg.Commands = [][]string{{"sh", "-c", "echo Up gauge 1"}}
+				cfg.ScrapeTargets = []ScrapeTarget{{URL: "http://localhost:9100/metrics"}}
+			},
+		},
+		{
+			name:    "Unknown probe kind",
+			set:     func(cfg *Config) { cfg.Probes = []Probe{{Label: "db", Kind: "udp", Target: "localhost:53"}} },
+			wantErr: true,
+		},
+		{
+			name:    "Probe without a target",
+			set:     func(cfg *Config) { cfg.Probes = []Probe{{Label: "db", Kind: ProbeTCP}} },
+			wantErr: true,
+		},
+		{
+			name:    "Empty command",
+			set:     func(cfg *Config) { cfg.Commands = [][]string{{}} },
+			wantErr: true,
+		},
+		{
+			name:    "Scrape target without a url",
+			set:     func(cfg *Config) { cfg.ScrapeTargets = []ScrapeTarget{{Label: "app"}} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.set(&cfg)
+			_, err := New(cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "localhost_9100", config.ScrapeTargets[0].Label)
+		})
+	}
+}
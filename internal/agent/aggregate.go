@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"math"
+	"strings"
+	"sync"
+)
+
+const (
+	AggregateLast = "last"
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+	AggregateAvg  = "avg"
+)
+
+type GaugeAggregation struct {
+	Pattern string
+	Mode    string
+}
+
+// aggregator merges every snapshot produced during a report interval:
+// counters are summed, gauges are reduced with the configured mode.
+type aggregator struct {
+	mu    sync.Mutex
+	mode  string
+	rules []GaugeAggregation
+
+	gauges   map[metrics.Name]*gaugeStat
+	counters map[metrics.Name]metrics.Counter
+}
+
+type gaugeStat struct {
+	last, min, max, sum float64
+	n                   int
+}
+
+// ParseGaugeAggregations parses "pattern=mode,..." where a pattern is a
+// metric name, optionally ending with "*" to match a prefix, e.g.
+// "CPUutilization*=avg,Load1=max".
+func ParseGaugeAggregations(spec string) ([]GaugeAggregation, error) {
+	var rules []GaugeAggregation
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pattern, mode, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("aggregation %q: expected pattern=mode", entry)
+		}
+		if err := validAggregation(mode); err != nil {
+			return nil, err
+		}
+		rules = append(rules, GaugeAggregation{Pattern: pattern, Mode: mode})
+	}
+	return rules, nil
+}
+
+func validAggregation(mode string) error {
+	switch mode {
+	case AggregateLast, AggregateMin, AggregateMax, AggregateAvg:
+		return nil
+	}
+	return fmt.Errorf("unknown gauge aggregation %q", mode)
+}
+
+func validAggregations(mode string, rules []GaugeAggregation) error {
+	if mode != "" {
+		if err := validAggregation(mode); err != nil {
+			return err
+		}
+	}
+	for _, r := range rules {
+		if err := validAggregation(r.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newAggregator(mode string, rules []GaugeAggregation) (*aggregator, error) {
+	ag := &aggregator{}
+	if err := ag.SetModes(mode, rules); err != nil {
+		return nil, err
+	}
+	ag.reset()
+	return ag, nil
+}
+
+// SetModes changes the gauge aggregation, it applies to the whole current
+// interval.
+func (ag *aggregator) SetModes(mode string, rules []GaugeAggregation) error {
+	if mode == "" {
+		mode = AggregateLast
+	}
+	if err := validAggregations(mode, rules); err != nil {
+		return err
+	}
+
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.mode, ag.rules = mode, rules
+	return nil
+}
+
+func (ag *aggregator) reset() {
+	ag.gauges = make(map[metrics.Name]*gaugeStat, metrics.GaugeLen)
+	ag.counters = make(map[metrics.Name]metrics.Counter, metrics.CounterLen)
+}
+
+func (ag *aggregator) Add(m metrics.Metrics) {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	for k, v := range m.Gauges {
+		value := float64(v)
+		s, ok := ag.gauges[k]
+		if !ok {
+			ag.gauges[k] = &gaugeStat{last: value, min: value, max: value, sum: value, n: 1}
+			continue
+		}
+		s.last = value
+		s.min = math.Min(s.min, value)
+		s.max = math.Max(s.max, value)
+		s.sum += value
+		s.n++
+	}
+	for k, v := range m.Counters {
+		ag.counters[k] += v
+	}
+}
+
+func (ag *aggregator) Empty() bool {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	return len(ag.gauges) == 0 && len(ag.counters) == 0
+}
+
+// Flush returns the aggregated batch and starts a new interval.
+func (ag *aggregator) Flush() metrics.Metrics {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+
+	prm := metrics.Metrics{
+		Gauges:   make(map[metrics.Name]metrics.Gauge, len(ag.gauges)),
+		Counters: ag.counters,
+	}
+
+	for k, s := range ag.gauges {
+		var value float64
+		switch ag.modeOf(k) {
+		case AggregateMin:
+			value = s.min
+		case AggregateMax:
+			value = s.max
+		case AggregateAvg:
+			value = s.sum / float64(s.n)
+		default:
+			value = s.last
+		}
+		prm.Gauges[k] = metrics.Gauge(value)
+	}
+
+	ag.reset()
+	return prm
+}
+
+func (ag *aggregator) modeOf(name metrics.Name) string {
+	for _, r := range ag.rules {
+		if strings.HasSuffix(r.Pattern, "*") {
+			if strings.HasPrefix(string(name), strings.TrimSuffix(r.Pattern, "*")) {
+				return r.Mode
+			}
+			continue
+		}
+		if r.Pattern == string(name) {
+			return r.Mode
+		}
+	}
+	return ag.mode
+}
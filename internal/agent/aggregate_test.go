@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAggregator_Flush(t *testing.T) {
+	snapshots := []metrics.Metrics{
+		{
+			Gauges:   map[metrics.Name]metrics.Gauge{"CPUutilization1": 10, "Load1": 2, "Alloc": 100},
+			Counters: map[metrics.Name]metrics.Counter{"PollCount": 1},
+		},
+		{
+			Gauges:   map[metrics.Name]metrics.Gauge{"CPUutilization1": 30, "Load1": 5, "Alloc": 50},
+			Counters: map[metrics.Name]metrics.Counter{"PollCount": 1},
+		},
+		{
+			Gauges:   map[metrics.Name]metrics.Gauge{"CPUutilization1": 20, "Load1": 1, "Alloc": 70},
+			Counters: map[metrics.Name]metrics.Counter{"PollCount": 1, "NetBytesSent": 400},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		rules string
+		want  map[metrics.Name]metrics.Gauge
+	}{
+		{
+			name: "Default last",
+			want: map[metrics.Name]metrics.Gauge{"CPUutilization1": 20, "Load1": 1, "Alloc": 70},
+		},
+		{
+			name: "Min",
+			mode: AggregateMin,
+			want: map[metrics.Name]metrics.Gauge{"CPUutilization1": 10, "Load1": 1, "Alloc": 50},
+		},
+		{
+			name: "Max",
+			mode: AggregateMax,
+			want: map[metrics.Name]metrics.Gauge{"CPUutilization1": 30, "Load1": 5, "Alloc": 100},
+		},
+		{
+			name:  "Rules override the default",
+			mode:  AggregateLast,
+			rules: "CPUutilization*=avg,Load1=max",
+			want:  map[metrics.Name]metrics.Gauge{"CPUutilization1": 20, "Load1": 5, "Alloc": 70},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseGaugeAggregations(tt.rules)
+			require.NoError(t, err)
+			ag, err := newAggregator(tt.mode, rules)
+			require.NoError(t, err)
+
+			for _, s := range snapshots {
+				ag.Add(s)
+			}
+			prm := ag.Flush()
+
+			assert.Equal(t, tt.want, prm.Gauges)
+			assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 3, "NetBytesSent": 400}, prm.Counters)
+			assert.True(t, ag.Empty())
+		})
+	}
+}
+
+func TestParseGaugeAggregations(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []GaugeAggregation
+		wantErr bool
+	}{
+		{
+			name: "Empty",
+			spec: "",
+		},
+		{
+			name: "Rules",
+			spec: "CPUutilization*=avg, Load1=max",
+			want: []GaugeAggregation{
+				{Pattern: "CPUutilization*", Mode: AggregateAvg},
+				{Pattern: "Load1", Mode: AggregateMax},
+			},
+		},
+		{
+			name:    "Unknown mode",
+			spec:    "Load1=median",
+			wantErr: true,
+		},
+		{
+			name:    "Missing mode",
+			spec:    "Load1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGaugeAggregations(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxRetryDelay = 30 * time.Second
+
+	breakerThreshold   = 5
+	breakerCooldown    = 5 * time.Second
+	maxBreakerCooldown = time.Minute
+)
+
+var ErrCircuitOpen = errors.New("server is unhealthy, sending paused")
+
+// StatusError is returned for a server response with an unexpected status.
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid status code %v", e.Code)
+}
+
+func newStatusError(code int, retryAfter string) *StatusError {
+	e := &StatusError{Code: code}
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		e.RetryAfter = time.Until(t)
+	}
+	return e
+}
+
+// retryable reports whether err is worth retrying and the delay the server
+// asked for, if any. Network errors, 5xx and 429 are retried, other
+// statuses are permanent.
+func retryable(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCircuitOpen) {
+		return false, 0
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		if se.Code == http.StatusTooManyRequests || se.Code >= http.StatusInternalServerError {
+			return true, se.RetryAfter
+		}
+		return false, 0
+	}
+	return true, 0
+}
+
+// The global source isn't seeded for this module's Go version, agents would
+// pick the same jitter.
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns a random delay in [d/2, d) where d doubles with every
+// attempt starting from delay, capped at maxRetryDelay.
+func backoff(delay time.Duration, attempt int) time.Duration {
+	d := delay
+	for i := 0; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return jitter(d)
+}
+
+// jitter returns a random delay in [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitterRand.Int63n(int64(d/2)+1))
+}
+
+// Retry retries sender on retryable errors with exponential backoff and
+// jitter. A Retry-After longer than the backoff is honoured.
+func Retry(sender Sender, retries int, delay time.Duration) Sender {
+	return func(ctx context.Context, prm metrics.Metrics) error {
+		for r := 0; ; r++ {
+			err := sender(ctx, prm)
+			if err == nil || r >= retries {
+				return err
+			}
+
+			ok, retryAfter := retryable(err)
+			if !ok {
+				return err
+			}
+
+			wait := backoff(delay, r)
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+			log.Printf("Function call failed, retrying in %v", wait)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// circuitBreaker pauses sending after breakerThreshold consecutive retryable
+// failures. Once the cooldown is over one call is let through, its failure
+// opens the breaker again for twice as long. The pause is jittered like the
+// retries so that agents cut off by the same outage don't probe together.
+type circuitBreaker struct {
+	name      string
+	mu        sync.Mutex
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, cooldown: breakerCooldown}
+}
+
+func (b *circuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) Done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		if b.failures >= breakerThreshold {
+			log.Printf("Server %s is healthy again, sending resumed", b.name)
+		}
+		b.failures = 0
+		b.cooldown = breakerCooldown
+		return
+	}
+	if ok, _ := retryable(err); !ok {
+		return
+	}
+
+	b.failures++
+	if b.failures < breakerThreshold {
+		return
+	}
+	if b.failures > breakerThreshold {
+		b.cooldown *= 2
+		if b.cooldown > maxBreakerCooldown {
+			b.cooldown = maxBreakerCooldown
+		}
+	}
+	pause := jitter(b.cooldown)
+	b.openUntil = time.Now().Add(pause)
+	log.Printf("Server %s is unhealthy, sending paused for %v", b.name, pause)
+}
+
+// guard wraps sender with the circuit breaker.
+func (b *circuitBreaker) guard(sender Sender) Sender {
+	return func(ctx context.Context, prm metrics.Metrics) error {
+		if err := b.Allow(); err != nil {
+			return err
+		}
+		err := sender(ctx, prm)
+		b.Done(err)
+		return err
+	}
+}
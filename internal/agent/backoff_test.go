@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+	}{
+		{
+			name:     "Success",
+			attempts: 1,
+		},
+		{
+			name:     "Network error is retried",
+			err:      errors.New("connection refused"),
+			attempts: 3,
+		},
+		{
+			name:     "Server error is retried",
+			err:      &StatusError{Code: http.StatusServiceUnavailable},
+			attempts: 3,
+		},
+		{
+			name:     "Too many requests is retried",
+			err:      &StatusError{Code: http.StatusTooManyRequests},
+			attempts: 3,
+		},
+		{
+			name:     "Bad request is permanent",
+			err:      &StatusError{Code: http.StatusBadRequest},
+			attempts: 1,
+		},
+		{
+			name:     "Open circuit is not retried",
+			err:      ErrCircuitOpen,
+			attempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			fn := Retry(func(ctx context.Context, prm metrics.Metrics) error {
+				attempts++
+				return tt.err
+			}, 2, time.Millisecond)
+
+			err := fn(context.Background(), metrics.Metrics{})
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.attempts, attempts)
+		})
+	}
+}
+
+func TestRetry_RetryAfter(t *testing.T) {
+	attempts := 0
+	fn := Retry(func(ctx context.Context, prm metrics.Metrics) error {
+		attempts++
+		if attempts == 1 {
+			return newStatusError(http.StatusTooManyRequests, "1")
+		}
+		return nil
+	}, 2, time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, fn(context.Background(), metrics.Metrics{}))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := backoff(time.Second, attempt)
+		assert.GreaterOrEqual(t, got, d/2)
+		assert.LessOrEqual(t, got, d)
+	}
+	assert.LessOrEqual(t, backoff(time.Second, 20), maxRetryDelay)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("localhost:8080")
+	unavailable := &StatusError{Code: http.StatusServiceUnavailable}
+
+	b.Done(&StatusError{Code: http.StatusBadRequest})
+	for i := 0; i < breakerThreshold; i++ {
+		assert.NoError(t, b.Allow())
+		b.Done(unavailable)
+	}
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	b.openUntil = time.Now()
+	assert.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen, "only one call passes while half-open")
+
+	b.Done(unavailable)
+	assert.Equal(t, 2*breakerCooldown, b.cooldown)
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	b.openUntil = time.Now()
+	assert.NoError(t, b.Allow())
+	b.Done(nil)
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, breakerCooldown, b.cooldown)
+}
+
+func TestCircuitBreaker_Jitter(t *testing.T) {
+	unavailable := &StatusError{Code: http.StatusServiceUnavailable}
+
+	pauses := make(map[time.Time]bool)
+	for i := 0; i < 10; i++ {
+		b := newCircuitBreaker("localhost:8080")
+		start := time.Now()
+		for j := 0; j < breakerThreshold; j++ {
+			b.Done(unavailable)
+		}
+		assert.GreaterOrEqual(t, b.openUntil.Sub(start), breakerCooldown/2)
+		assert.LessOrEqual(t, b.openUntil.Sub(time.Now()), breakerCooldown)
+		pauses[b.openUntil] = true
+	}
+	assert.Greater(t, len(pauses), 1, "breakers opened together pause for different times")
+}
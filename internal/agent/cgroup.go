@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CgroupSelf = "self"
+
+	cgroupRoot     = "/sys/fs/cgroup"
+	selfCgroupFile = "/proc/self/cgroup"
+)
+
+type cgroupWatch struct {
+	label string
+	dir   string
+}
+
+func newCgroupWatches(root string, paths []string) ([]cgroupWatch, error) {
+	watches := make([]cgroupWatch, 0, len(paths))
+	for _, p := range paths {
+		w := cgroupWatch{label: mountName(p), dir: filepath.Join(root, p)}
+		if p == CgroupSelf {
+			self, err := selfCgroup(selfCgroupFile)
+			if err != nil {
+				return nil, err
+			}
+			w = cgroupWatch{label: CgroupSelf, dir: filepath.Join(root, self)}
+		}
+		if _, err := os.Stat(filepath.Join(w.dir, "cgroup.controllers")); err != nil {
+			return nil, fmt.Errorf("cgroup %s is not a cgroup v2 directory - %w", w.dir, err)
+		}
+		watches = append(watches, w)
+	}
+	return watches, nil
+}
+
+func selfCgroup(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 entry not found in %s", filename)
+}
+
+func (a *Agent) CgroupTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	ticker := time.NewTicker(a.pollInterval())
+	for {
+		select {
+		case <-ticker.C:
+			a.cgroupUpdate(metricsCh)
+		case <-ctx.Done():
+			log.Println("Regular completion of the cgroup metrics update")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (a *Agent) cgroupUpdate(metricsCh chan<- metrics.Metrics) {
+	prm := metrics.New()
+
+	for _, w := range a.cgroups {
+		a.readCgroup(w, prm)
+	}
+
+	metricsCh <- *prm
+
+	log.Println("Cgroup metrics updated")
+}
+
+func (a *Agent) readCgroup(w cgroupWatch, prm *metrics.Metrics) {
+	if v, err := readCgroupValue(filepath.Join(w.dir, "memory.current")); err == nil {
+		prm.Gauges[deviceName(metrics.CgroupMemoryCurrent, w.label)] = metrics.Gauge(v)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		a.handleError(err)
+	}
+
+	// memory.max holds "max" when no limit is set, which is not reported.
+	if v, err := readCgroupValue(filepath.Join(w.dir, "memory.max")); err == nil {
+		prm.Gauges[deviceName(metrics.CgroupMemoryMax, w.label)] = metrics.Gauge(v)
+	}
+
+	if v, err := readCgroupValue(filepath.Join(w.dir, "pids.current")); err == nil {
+		prm.Gauges[deviceName(metrics.CgroupPids, w.label)] = metrics.Gauge(v)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		a.handleError(err)
+	}
+
+	stat, err := readCgroupKeyed(filepath.Join(w.dir, "cpu.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		a.handleError(err)
+	}
+	for key, name := range map[string]metrics.Name{
+		"usage_usec":     metrics.CgroupCPUUsage,
+		"user_usec":      metrics.CgroupCPUUser,
+		"system_usec":    metrics.CgroupCPUSystem,
+		"nr_throttled":   metrics.CgroupCPUThrottled,
+		"throttled_usec": metrics.CgroupCPUThrottledTime,
+	} {
+		if v, ok := stat[key]; ok {
+			a.putDelta(prm.Counters, deviceName(name, w.label), v)
+		}
+	}
+
+	io, err := readCgroupIO(filepath.Join(w.dir, "io.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		a.handleError(err)
+	}
+	for key, name := range map[string]metrics.Name{
+		"rbytes": metrics.CgroupIOReadBytes,
+		"wbytes": metrics.CgroupIOWriteBytes,
+		"rios":   metrics.CgroupIOReads,
+		"wios":   metrics.CgroupIOWrites,
+	} {
+		if v, ok := io[key]; ok {
+			a.putDelta(prm.Counters, deviceName(name, w.label), v)
+		}
+	}
+}
+
+func readCgroupValue(filename string) (uint64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeyed reads flat keyed files such as cpu.stat ("key value" per line).
+func readCgroupKeyed(filename string) (map[string]uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		values[fields[0]] = v
+	}
+	return values, scanner.Err()
+}
+
+// readCgroupIO reads io.stat ("MAJ:MIN key=value ..." per device) and sums
+// every key over all devices.
+func readCgroupIO(filename string) (map[string]uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			values[key] += v
+		}
+	}
+	return values, scanner.Err()
+}
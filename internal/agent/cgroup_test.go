@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+}
+
+func TestAgent_readCgroup(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "system.slice", "app.service")
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"cgroup.controllers": "cpu io memory pids\n",
+		"memory.current":     "1048576\n",
+		"memory.max":         "max\n",
+		"pids.current":       "7\n",
+		"cpu.stat":           "usage_usec 1000\nuser_usec 600\nsystem_usec 400\nnr_periods 0\nnr_throttled 0\nthrottled_usec 0\n",
+		"io.stat":            "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=50 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	})
+
+	watches, err := newCgroupWatches(root, []string{"/system.slice/app.service"})
+	require.NoError(t, err)
+	require.Len(t, watches, 1)
+
+	a := &Agent{lastCounters: make(map[metrics.Name]uint64)}
+
+	prm := metrics.New()
+	a.readCgroup(watches[0], prm)
+
+	label := "system.slice_app.service"
+	assert.Equal(t, metrics.Gauge(1048576), prm.Gauges[deviceName(metrics.CgroupMemoryCurrent, label)])
+	assert.Equal(t, metrics.Gauge(7), prm.Gauges[deviceName(metrics.CgroupPids, label)])
+	assert.NotContains(t, prm.Gauges, deviceName(metrics.CgroupMemoryMax, label))
+	assert.Empty(t, prm.Counters, "first poll only sets the counters baseline")
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"memory.max": "2097152\n",
+		"cpu.stat":   "usage_usec 1500\nuser_usec 900\nsystem_usec 600\nnr_periods 0\nnr_throttled 0\nthrottled_usec 0\n",
+		"io.stat":    "8:0 rbytes=300 wbytes=200 rios=3 wios=2 dbytes=0 dios=0\n8:16 rbytes=50 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	})
+
+	prm = metrics.New()
+	a.readCgroup(watches[0], prm)
+
+	assert.Equal(t, metrics.Gauge(2097152), prm.Gauges[deviceName(metrics.CgroupMemoryMax, label)])
+	assert.Equal(t, metrics.Counter(500), prm.Counters[deviceName(metrics.CgroupCPUUsage, label)])
+	assert.Equal(t, metrics.Counter(300), prm.Counters[deviceName(metrics.CgroupCPUUser, label)])
+	assert.Equal(t, metrics.Counter(200), prm.Counters[deviceName(metrics.CgroupIOReadBytes, label)])
+	assert.Equal(t, metrics.Counter(0), prm.Counters[deviceName(metrics.CgroupIOWriteBytes, label)])
+	assert.Equal(t, metrics.Counter(2), prm.Counters[deviceName(metrics.CgroupIOReads, label)])
+}
+
+func TestNewCgroupWatches_InvalidPath(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "not-a-cgroup"), 0755))
+
+	_, err := newCgroupWatches(root, []string{"/missing.slice"})
+	require.Error(t, err)
+
+	_, err = newCgroupWatches(root, []string{"/not-a-cgroup"})
+	require.Error(t, err)
+}
+
+func TestSelfCgroup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cgroup")
+	require.NoError(t, os.WriteFile(filename, []byte("0::/docker/abc123\n"), 0644))
+
+	path, err := selfCgroup(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "/docker/abc123", path)
+}
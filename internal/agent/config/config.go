@@ -2,26 +2,155 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env"
+	"gopkg.in/yaml.v3"
 	"os"
 )
 
 type Config struct {
-	Addr           string `env:"ADDRESS" envDefault:"127.0.0.1:8080"`
-	ReportInterval int    `env:"REPORT_INTERVAL" envDefault:"10"`
-	PollInterval   int    `env:"POLL_INTERVAL" envDefault:"2"`
-	Key            string `env:"KEY"`
-	RateLimit      int    `env:"RATE_LIMIT" envDefault:"3"`
+	Addr            string `env:"ADDRESS" envDefault:"127.0.0.1:8080" yaml:"address"`
+	ReportInterval  int    `env:"REPORT_INTERVAL" envDefault:"10" yaml:"report_interval"`
+	PollInterval    int    `env:"POLL_INTERVAL" envDefault:"2" yaml:"poll_interval"`
+	Key             string `env:"KEY" yaml:"key"`
+	RateLimit       int    `env:"RATE_LIMIT" envDefault:"3" yaml:"rate_limit"`
+	Processes       string `env:"PROCESSES" yaml:"-"`
+	Cgroups         string `env:"CGROUPS" yaml:"-"`
+	Commands        string `env:"EXEC_COMMANDS" yaml:"-"`
+	CommandTimeout  int    `env:"EXEC_TIMEOUT" envDefault:"5" yaml:"exec_timeout"`
+	ScrapeTargets   string `env:"SCRAPE_TARGETS" yaml:"-"`
+	Probes          string `env:"PROBES" yaml:"-"`
+	QueueDir        string `env:"QUEUE_DIR" yaml:"queue_dir"`
+	QueueMaxSize    int64  `env:"QUEUE_MAX_SIZE" envDefault:"67108864" yaml:"queue_max_size"`
+	QueueMaxAge     int    `env:"QUEUE_MAX_AGE" envDefault:"86400" yaml:"queue_max_age"`
+	Aggregation     string `env:"AGGREGATION" envDefault:"last" yaml:"aggregation"`
+	AggregateRules  string `env:"AGGREGATION_RULES" yaml:"-"`
+	ShutdownTimeout int    `env:"SHUTDOWN_TIMEOUT" envDefault:"10" yaml:"shutdown_timeout"`
+	Strategy        string `env:"SEND_STRATEGY" envDefault:"failover" yaml:"send_strategy"`
+	ID              string `env:"AGENT_ID" yaml:"agent_id"`
+	Group           string `env:"AGENT_GROUP" yaml:"agent_group"`
+	ConfigInterval  int    `env:"CONFIG_INTERVAL" envDefault:"60" yaml:"config_interval"`
+	ConfigFile      string `env:"CONFIG" yaml:"-"`
+
+	// Collectors are set by the config file, a flag or env var with the
+	// encoded form of a list replaces the list of the file.
+	Collectors `yaml:",inline"`
+}
+
+// Collectors are the collector settings as the config file lists them.
+type Collectors struct {
+	ProcessList       []Process       `yaml:"processes"`
+	CgroupList        []string        `yaml:"cgroups"`
+	CommandList       [][]string      `yaml:"exec_commands"`
+	ScrapeTargetList  []ScrapeTarget  `yaml:"scrape_targets"`
+	ProbeList         []Probe         `yaml:"probes"`
+	AggregateRuleList []AggregateRule `yaml:"aggregation_rules"`
+}
+
+// Process is a watched process, Match is pidfile, name or cmdline.
+type Process struct {
+	Label   string `yaml:"label"`
+	Match   string `yaml:"match"`
+	Pattern string `yaml:"pattern"`
+}
+
+// ScrapeTarget is an HTTP target, the label defaults to its host and port.
+type ScrapeTarget struct {
+	Label string `yaml:"label"`
+	URL   string `yaml:"url"`
+}
+
+// Probe is a check of a target, Kind is http, tcp or dns.
+type Probe struct {
+	Label  string `yaml:"label"`
+	Kind   string `yaml:"kind"`
+	Target string `yaml:"target"`
+}
+
+// AggregateRule is the aggregation of the gauges matching Pattern, a name
+// or a prefix ending with "*".
+type AggregateRule struct {
+	Pattern string `yaml:"pattern"`
+	Mode    string `yaml:"mode"`
 }
 
+var (
+	config   = new(Config)
+	flags    = flag.CommandLine
+	setFlags = make(map[string]string)
+)
+
+// ParseConfig reads the agent config. Env vars take precedence over flags,
+// flags over the config file and the file over the defaults.
 func ParseConfig() (Config, error) {
-	config := new(Config)
-	flag.StringVar(&config.Addr, "a", "127.0.0.1:8080", "address to listen on")
-	flag.IntVar(&config.ReportInterval, "r", 10, "write metrics to file interval")
-	flag.IntVar(&config.PollInterval, "p", 2, "write metrics to file interval")
-	flag.StringVar(&config.Key, "k", "", "Encryption key")
-	flag.IntVar(&config.RateLimit, "l", 3, "Rate Limit")
-	flag.Parse()
+	return parse(flag.CommandLine, os.Args[1:])
+}
+
+func parse(fs *flag.FlagSet, args []string) (Config, error) {
+	flags = fs
+	fs.StringVar(&config.ConfigFile, "c", "", "YAML or JSON config file, reloaded on SIGHUP")
+	fs.StringVar(&config.Addr, "a", "127.0.0.1:8080", "Comma-separated server addresses")
+	fs.IntVar(&config.ReportInterval, "r", 10, "write metrics to file interval")
+	fs.IntVar(&config.PollInterval, "p", 2, "write metrics to file interval")
+	fs.StringVar(&config.Key, "k", "", "Encryption key")
+	fs.IntVar(&config.RateLimit, "l", 3, "Rate Limit")
+	fs.StringVar(&config.Processes, "ps", "", "Watched processes in format <label>=<pidfile|name|cmdline>:<pattern>;...")
+	fs.StringVar(&config.Cgroups, "cg", "", "Comma-separated cgroup v2 paths, `self` for the agent's own cgroup")
+	fs.StringVar(&config.Commands, "e", "", "Commands printing metrics as a JSON array of argv lists, e.g. [[\"sh\",\"-c\",\"...\"]]")
+	fs.IntVar(&config.CommandTimeout, "et", 5, "Command timeout in seconds")
+	fs.StringVar(&config.ScrapeTargets, "s", "", "Comma-separated HTTP targets to scrape in format [<label>=]<url>")
+	fs.StringVar(&config.Probes, "pr", "", "Comma-separated probes in format <label>=<http|tcp|dns>:<target>")
+	fs.StringVar(&config.QueueDir, "q", "", "Directory for metrics not delivered to the server")
+	fs.Int64Var(&config.QueueMaxSize, "qs", 64<<20, "Max size of undelivered metrics on disk in bytes")
+	fs.IntVar(&config.QueueMaxAge, "qa", 86400, "Max age of undelivered metrics in seconds")
+	fs.StringVar(&config.Aggregation, "ag", "last", "Gauge aggregation between reports: last, min, max or avg")
+	fs.StringVar(&config.AggregateRules, "agr", "", "Per-gauge aggregation in format <name|prefix*>=<mode>,...")
+	fs.IntVar(&config.ShutdownTimeout, "st", 10, "Deadline for sending the last metrics on shutdown in seconds")
+	fs.StringVar(&config.Strategy, "m", "failover", "Sending to several servers: failover, roundrobin or fanout")
+	fs.StringVar(&config.ID, "id", "", "Agent id for the server-side settings, the host name by default")
+	fs.StringVar(&config.Group, "g", "", "Agent group for the server-side settings")
+	fs.IntVar(&config.ConfigInterval, "ci", 60, "Agent settings pull interval in seconds, 0 disables it")
+	if err := fs.Parse(args); err != nil {
+		return *config, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	return load()
+}
+
+// Reload reads the config file again, flags and env vars keep their
+// precedence.
+func Reload() (Config, error) {
+	return load()
+}
+
+func load() (Config, error) {
+	flags.VisitAll(func(f *flag.Flag) {
+		_ = f.Value.Set(f.DefValue)
+	})
+	config.Collectors = Collectors{}
+
+	filename := setFlags["c"]
+	if v, ok := os.LookupEnv("CONFIG"); ok {
+		filename = v
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return *config, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return *config, fmt.Errorf("could not parse config file %s - %w", filename, err)
+		}
+		config.ConfigFile = filename
+	}
+
+	for name, value := range setFlags {
+		_ = flags.Set(name, value)
+	}
 
 	envConfig := Config{}
 	err := env.Parse(&envConfig)
@@ -44,6 +173,54 @@ func ParseConfig() (Config, error) {
 	if _, ok := os.LookupEnv("RATE_LIMIT"); ok {
 		config.RateLimit = envConfig.RateLimit
 	}
+	if _, ok := os.LookupEnv("PROCESSES"); ok {
+		config.Processes = envConfig.Processes
+	}
+	if _, ok := os.LookupEnv("CGROUPS"); ok {
+		config.Cgroups = envConfig.Cgroups
+	}
+	if _, ok := os.LookupEnv("EXEC_COMMANDS"); ok {
+		config.Commands = envConfig.Commands
+	}
+	if _, ok := os.LookupEnv("EXEC_TIMEOUT"); ok {
+		config.CommandTimeout = envConfig.CommandTimeout
+	}
+	if _, ok := os.LookupEnv("SCRAPE_TARGETS"); ok {
+		config.ScrapeTargets = envConfig.ScrapeTargets
+	}
+	if _, ok := os.LookupEnv("PROBES"); ok {
+		config.Probes = envConfig.Probes
+	}
+	if _, ok := os.LookupEnv("QUEUE_DIR"); ok {
+		config.QueueDir = envConfig.QueueDir
+	}
+	if _, ok := os.LookupEnv("QUEUE_MAX_SIZE"); ok {
+		config.QueueMaxSize = envConfig.QueueMaxSize
+	}
+	if _, ok := os.LookupEnv("QUEUE_MAX_AGE"); ok {
+		config.QueueMaxAge = envConfig.QueueMaxAge
+	}
+	if _, ok := os.LookupEnv("AGGREGATION"); ok {
+		config.Aggregation = envConfig.Aggregation
+	}
+	if _, ok := os.LookupEnv("AGGREGATION_RULES"); ok {
+		config.AggregateRules = envConfig.AggregateRules
+	}
+	if _, ok := os.LookupEnv("SHUTDOWN_TIMEOUT"); ok {
+		config.ShutdownTimeout = envConfig.ShutdownTimeout
+	}
+	if _, ok := os.LookupEnv("SEND_STRATEGY"); ok {
+		config.Strategy = envConfig.Strategy
+	}
+	if _, ok := os.LookupEnv("AGENT_ID"); ok {
+		config.ID = envConfig.ID
+	}
+	if _, ok := os.LookupEnv("AGENT_GROUP"); ok {
+		config.Group = envConfig.Group
+	}
+	if _, ok := os.LookupEnv("CONFIG_INTERVAL"); ok {
+		config.ConfigInterval = envConfig.ConfigInterval
+	}
 
 	return *config, nil
 }
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseArgs parses args like ParseConfig does for the command line, on a
+// fresh config.
+func parseArgs(args ...string) (Config, error) {
+	config = new(Config)
+	setFlags = make(map[string]string)
+	return parse(flag.NewFlagSet("agent", flag.ContinueOnError), args)
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0666))
+	return filename
+}
+
+const file = `
+address: 10.0.0.1:8080,10.0.0.2:8080
+report_interval: 20
+poll_interval: 7
+key: secret
+rate_limit: 5
+send_strategy: fanout
+processes:
+  - label: nginx
+    match: name
+    pattern: nginx
+  - label: db
+    match: pidfile
+    pattern: /run/postgres.pid
+cgroups: [self, /sys/fs/cgroup/app]
+exec_commands:
+  - [/opt/checks/queue.sh]
+  - [sh, -c, echo Up gauge 1]
+scrape_targets:
+  - url: http://localhost:9100/metrics
+  - label: app
+    url: http://localhost:8081/metrics
+probes:
+  - label: site
+    kind: http
+    target: https://example.com
+aggregation_rules:
+  - pattern: CPUutilization*
+    mode: avg
+`
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want func(t *testing.T, conf Config)
+	}{
+		{
+			name: "Defaults",
+			want: func(t *testing.T, conf Config) {
+				assert.Equal(t, "127.0.0.1:8080", conf.Addr)
+				assert.Equal(t, 10, conf.ReportInterval)
+				assert.Equal(t, 2, conf.PollInterval)
+				assert.Equal(t, 3, conf.RateLimit)
+				assert.Equal(t, "failover", conf.Strategy)
+				assert.Equal(t, Collectors{}, conf.Collectors)
+			},
+		},
+		{
+			name: "File over defaults",
+			file: file,
+			want: func(t *testing.T, conf Config) {
+				assert.Equal(t, "10.0.0.1:8080,10.0.0.2:8080", conf.Addr)
+				assert.Equal(t, 20, conf.ReportInterval)
+				assert.Equal(t, 7, conf.PollInterval)
+				assert.Equal(t, "secret", conf.Key)
+				assert.Equal(t, 5, conf.RateLimit)
+				assert.Equal(t, "fanout", conf.Strategy)
+				assert.Equal(t, 5, conf.CommandTimeout, "not in the file")
+				assert.Equal(t, Collectors{
+					ProcessList: []Process{
+						{Label: "nginx", Match: "name", Pattern: "nginx"},
+						{Label: "db", Match: "pidfile", Pattern: "/run/postgres.pid"},
+					},
+					CgroupList:  []string{"self", "/sys/fs/cgroup/app"},
+					CommandList: [][]string{{"/opt/checks/queue.sh"}, {"sh", "-c", "echo Up gauge 1"}},
+					ScrapeTargetList: []ScrapeTarget{
+						{URL: "http://localhost:9100/metrics"},
+						{Label: "app", URL: "http://localhost:8081/metrics"},
+					},
+					ProbeList:         []Probe{{Label: "site", Kind: "http", Target: "https://example.com"}},
+					AggregateRuleList: []AggregateRule{{Pattern: "CPUutilization*", Mode: "avg"}},
+				}, conf.Collectors)
+			},
+		},
+		{
+			name: "JSON file",
+			file: `{"address": "10.0.0.3:8080", "probes": [{"label": "db", "kind": "tcp", "target": "10.0.0.5:5432"}]}`,
+			want: func(t *testing.T, conf Config) {
+				assert.Equal(t, "10.0.0.3:8080", conf.Addr)
+				assert.Equal(t, []Probe{{Label: "db", Kind: "tcp", Target: "10.0.0.5:5432"}}, conf.ProbeList)
+			},
+		},
+		{
+			name: "Flags over file",
+			args: []string{"-r", "5", "-ps", "api=cmdline:api-server"},
+			file: file,
+			want: func(t *testing.T, conf Config) {
+				assert.Equal(t, 5, conf.ReportInterval)
+				assert.Equal(t, 7, conf.PollInterval)
+				assert.Equal(t, "api=cmdline:api-server", conf.Processes)
+			},
+		},
+		{
+			name: "Env over flags",
+			args: []string{"-r", "5", "-a", "10.0.0.9:8080"},
+			env:  map[string]string{"REPORT_INTERVAL": "3", "PROBES": "db=tcp:10.0.0.5:5432"},
+			file: file,
+			want: func(t *testing.T, conf Config) {
+				assert.Equal(t, 3, conf.ReportInterval)
+				assert.Equal(t, "10.0.0.9:8080", conf.Addr)
+				assert.Equal(t, 7, conf.PollInterval)
+				assert.Equal(t, "db=tcp:10.0.0.5:5432", conf.Probes)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				filename := writeFile(t, "agent.yaml", tt.file)
+				args = append([]string{"-c", filename}, args...)
+			}
+
+			conf, err := parseArgs(args...)
+			require.NoError(t, err)
+			tt.want(t, conf)
+		})
+	}
+}
+
+func TestParseConfig_ConfigEnv(t *testing.T) {
+	ignored := writeFile(t, "ignored.yaml", "report_interval: 30\n")
+	t.Setenv("CONFIG", writeFile(t, "agent.yaml", "report_interval: 40\n"))
+
+	conf, err := parseArgs("-c", ignored)
+	require.NoError(t, err)
+	assert.Equal(t, 40, conf.ReportInterval)
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	_, err := parseArgs("-c", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+
+	_, err = parseArgs("-c", writeFile(t, "agent.yaml", "processes: nginx\n"))
+	assert.ErrorContains(t, err, "could not parse config file")
+
+	_, err = parseArgs("-unknown")
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	filename := writeFile(t, "agent.yaml", file)
+	_, err := parseArgs("-c", filename, "-p", "1")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filename, []byte("report_interval: 15\npoll_interval: 9\n"), 0666))
+	conf, err := Reload()
+	require.NoError(t, err)
+
+	assert.Equal(t, 15, conf.ReportInterval)
+	assert.Equal(t, 1, conf.PollInterval, "the flag keeps its precedence")
+	assert.Equal(t, "127.0.0.1:8080", conf.Addr, "removed from the file")
+	assert.Equal(t, "", conf.Key)
+	assert.Equal(t, Collectors{}, conf.Collectors, "removed from the file")
+}
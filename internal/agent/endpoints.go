@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/agent/queue"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyFailover   = "failover"
+	StrategyRoundRobin = "roundrobin"
+	StrategyFanOut     = "fanout"
+
+	endpointQueueDir = "endpoints"
+)
+
+// endpoint is a server the agent reports to, its breaker tracks the health.
+type endpoint struct {
+	address string
+	breaker *circuitBreaker
+}
+
+// route is everything the senders need to deliver a batch. It's replaced as
+// a whole when the config is reloaded.
+type route struct {
+	endpoints []*endpoint
+	strategy  string
+	key       string
+	id        string
+}
+
+func newRoute(cfg Config) (*route, error) {
+	switch cfg.Strategy {
+	case "", StrategyFailover, StrategyRoundRobin, StrategyFanOut:
+	default:
+		return nil, fmt.Errorf("unknown send strategy %q", cfg.Strategy)
+	}
+
+	r := &route{strategy: cfg.Strategy, key: cfg.Key, id: cfg.ID}
+	for _, address := range cfg.Addresses {
+		if address == "" {
+			return nil, fmt.Errorf("empty server address")
+		}
+		r.endpoints = append(r.endpoints, &endpoint{address: address, breaker: newCircuitBreaker(address)})
+	}
+	return r, nil
+}
+
+func (a *Agent) currentRoute() *route {
+	a.routeMu.RLock()
+	defer a.routeMu.RUnlock()
+	return a.route
+}
+
+// send delivers prm according to the route strategy. With failover and
+// round-robin one endpoint gets the batch, the next one is tried on error.
+// With fan-out every endpoint gets it and the send fails only if all of
+// them failed, an endpoint that missed it gets it with its next batch.
+func (a *Agent) send(ctx context.Context, prm metrics.Metrics) error {
+	r := a.currentRoute()
+	if r.strategy == StrategyFanOut {
+		return a.fanOut(ctx, r, prm)
+	}
+	return Retry(a.telemetry.retried(func(ctx context.Context, prm metrics.Metrics) error {
+		return a.sendNext(ctx, r, prm)
+	}), 3, 1*time.Second)(ctx, prm)
+}
+
+func (a *Agent) sendNext(ctx context.Context, r *route, prm metrics.Metrics) error {
+	start := 0
+	if r.strategy == StrategyRoundRobin {
+		start = int(atomic.AddUint32(&a.next, 1)-1) % len(r.endpoints)
+	}
+
+	var err error
+	for i := range r.endpoints {
+		e := r.endpoints[(start+i)%len(r.endpoints)]
+		sendErr := e.breaker.guard(a.sender(r, e))(ctx, prm)
+		if sendErr == nil {
+			return nil
+		}
+		if len(r.endpoints) > 1 {
+			log.Printf("Server %s failed, trying the next one - %v", e.address, sendErr)
+		}
+		// A retryable error is kept over an open circuit, so the batch is
+		// retried while at least one endpoint may accept it.
+		if ok, _ := retryable(sendErr); ok || err == nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+func (a *Agent) fanOut(ctx context.Context, r *route, prm metrics.Metrics) error {
+	errs := make([]error, len(r.endpoints))
+	queues := make([]*queue.Queue, len(r.endpoints))
+
+	var wg sync.WaitGroup
+	for i, e := range r.endpoints {
+		wg.Add(1)
+		go func(i int, e *endpoint) {
+			defer wg.Done()
+			queues[i], errs[i] = a.fanOutTo(ctx, r, e, prm)
+		}(i, e)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	// The caller keeps the batch when nobody got it.
+	if failed == len(r.endpoints) {
+		return errs[0]
+	}
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		log.Printf("Server %s missed the report - %v", r.endpoints[i].address, err)
+		if queues[i] == nil {
+			a.telemetry.add(metrics.AgentBatchesLost, 1)
+			continue
+		}
+		if err := queues[i].Push(prm); err != nil {
+			a.handleError(fmt.Errorf("could not queue metrics for %s - %w", r.endpoints[i].address, err))
+			a.telemetry.add(metrics.AgentBatchesLost, 1)
+		}
+	}
+	return nil
+}
+
+// fanOutTo sends prm to one endpoint together with the batches it missed
+// before. It returns the queue of the endpoint, nil without a queue
+// directory.
+func (a *Agent) fanOutTo(ctx context.Context, r *route, e *endpoint, prm metrics.Metrics) (*queue.Queue, error) {
+	q, err := a.endpointQueue(e.address)
+	if err != nil {
+		a.handleError(err)
+	}
+
+	batch := prm
+	var segments []uint64
+	if q != nil && q.Len() > 0 {
+		missed, s, err := q.Drain()
+		if err != nil {
+			a.handleError(fmt.Errorf("could not read metrics queued for %s - %w", e.address, err))
+		} else {
+			missed.Merge(prm)
+			batch = missed
+			segments = s
+		}
+	}
+
+	err = Retry(a.telemetry.retried(e.breaker.guard(a.sender(r, e))), 3, 1*time.Second)(ctx, batch)
+	if q == nil || len(segments) == 0 {
+		return q, err
+	}
+	if err != nil {
+		q.Release(segments)
+		return q, err
+	}
+	if err := q.Remove(segments); err != nil {
+		a.handleError(err)
+	}
+	return q, nil
+}
+
+// endpointQueue returns the queue of the batches an endpoint missed while
+// fanning out. It's kept in a directory of its own under the agent queue,
+// so it outlives config reloads and restarts.
+func (a *Agent) endpointQueue(address string) (*queue.Queue, error) {
+	if a.queue == nil {
+		return nil, nil
+	}
+
+	a.endpointQueuesMu.Lock()
+	defer a.endpointQueuesMu.Unlock()
+
+	if q, ok := a.endpointQueues[address]; ok {
+		return q, nil
+	}
+	cfg := config.Queue
+	cfg.Dir = filepath.Join(cfg.Dir, endpointQueueDir, url.PathEscape(address))
+	q, err := queue.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the queue for %s - %w", address, err)
+	}
+	if a.endpointQueues == nil {
+		a.endpointQueues = make(map[string]*queue.Queue)
+	}
+	a.endpointQueues[address] = q
+	return q, nil
+}
+
+func (a *Agent) sender(r *route, e *endpoint) Sender {
+	return func(ctx context.Context, prm metrics.Metrics) error {
+		return a.sendReportUpdates(ctx, r, e.address, prm)
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/internal/agent/queue"
+	"github.com/Osselnet/metrics-collector/internal/server/handlers"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAgent_send(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		down     []bool
+		sends    int
+		want     []int32
+		wantErr  bool
+	}{
+		{
+			name:     "Failover to the second server",
+			strategy: StrategyFailover,
+			down:     []bool{true, false},
+			sends:    2,
+			want:     []int32{0, 2},
+		},
+		{
+			name:     "Failover stays on the first server",
+			strategy: StrategyFailover,
+			down:     []bool{false, false},
+			sends:    2,
+			want:     []int32{2, 0},
+		},
+		{
+			name:     "Round robin",
+			strategy: StrategyRoundRobin,
+			down:     []bool{false, false},
+			sends:    4,
+			want:     []int32{2, 2},
+		},
+		{
+			name:     "Fan out",
+			strategy: StrategyFanOut,
+			down:     []bool{false, false},
+			sends:    2,
+			want:     []int32{2, 2},
+		},
+		{
+			name:     "Fan out with one server down",
+			strategy: StrategyFanOut,
+			down:     []bool{false, true},
+			sends:    1,
+			want:     []int32{1, 0},
+		},
+		{
+			name:     "All servers down",
+			strategy: StrategyFanOut,
+			down:     []bool{true, true},
+			sends:    1,
+			want:     []int32{0, 0},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := make([]int32, len(tt.down))
+			addresses := make([]string, len(tt.down))
+			for i, down := range tt.down {
+				i := i
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.AddInt32(&hits[i], 1)
+				}))
+				addresses[i] = strings.TrimPrefix(server.URL, "http://")
+				if down {
+					server.Close()
+				} else {
+					defer server.Close()
+				}
+			}
+
+			a, err := New(Config{
+				Timeout:        time.Second,
+				PollInterval:   time.Second,
+				ReportInterval: time.Second,
+				Addresses:      addresses,
+				Strategy:       tt.strategy,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			prm := metrics.Metrics{Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1}}
+			for i := 0; i < tt.sends; i++ {
+				err = a.send(ctx, prm)
+				if tt.wantErr {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+
+			for i := range hits {
+				assert.Equal(t, tt.want[i], atomic.LoadInt32(&hits[i]), "server %d", i)
+			}
+		})
+	}
+}
+
+func TestAgent_fanOutMissed(t *testing.T) {
+	up := handlers.New(chi.NewRouter(), nil, "", false, "")
+	upServer := httptest.NewServer(up.GetRouter())
+	defer upServer.Close()
+
+	var down int32 = 1
+	flaky := handlers.New(chi.NewRouter(), nil, "", false, "")
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		flaky.GetRouter().ServeHTTP(w, r)
+	}))
+	defer flakyServer.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Addresses: []string{
+			strings.TrimPrefix(upServer.URL, "http://"),
+			strings.TrimPrefix(flakyServer.URL, "http://"),
+		},
+		Strategy: StrategyFanOut,
+		Queue:    queue.Config{Dir: t.TempDir()},
+	})
+	require.NoError(t, err)
+
+	prm := metrics.Metrics{Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.report(ctx, prm))
+	assert.Equal(t, 0, a.queue.Len(), "the batch reached a server")
+
+	atomic.StoreInt32(&down, 0)
+	require.NoError(t, a.report(context.Background(), prm))
+
+	got, err := up.Storage.Get(context.Background(), string(metrics.PollCount))
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), got)
+	got, err = flaky.Storage.Get(context.Background(), string(metrics.PollCount))
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), got, "the missed batch is delivered with the next one")
+}
+
+func TestNew_strategy(t *testing.T) {
+	_, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Addresses:      []string{"localhost:8080", "localhost:8081"},
+		Strategy:       "random",
+	})
+	assert.Error(t, err)
+}
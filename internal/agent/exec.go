@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultCommandTimeout = 5 * time.Second
+
+func (a *Agent) ExecTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	ticker := time.NewTicker(a.pollInterval())
+	for {
+		select {
+		case <-ticker.C:
+			a.execUpdate(ctx, metricsCh)
+		case <-ctx.Done():
+			log.Println("Regular completion of the exec metrics update")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (a *Agent) execUpdate(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	prm := metrics.New()
+
+	for _, command := range config.Commands {
+		out, err := runCommand(ctx, command, config.CommandTimeout)
+		if err != nil {
+			a.handleError(fmt.Errorf("command %q failed - %w", command, err))
+			continue
+		}
+
+		m, err := parseExecOutput(out)
+		if err != nil {
+			a.handleError(fmt.Errorf("command %q output - %w", command, err))
+			continue
+		}
+		for k, v := range m.Gauges {
+			prm.Gauges[k] = v
+		}
+		for k, v := range m.Counters {
+			prm.Counters[k] += v
+		}
+	}
+
+	metricsCh <- *prm
+
+	log.Println("Exec metrics updated")
+}
+
+// ParseCommands parses commands given as a JSON array of argv lists, e.g.
+// [["/opt/checks/queue.sh"],["sh","-c","echo Up gauge 1"]]. Arguments are
+// passed as is, without any shell quoting rules.
+func ParseCommands(spec string) ([][]string, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var commands [][]string
+	if err := json.Unmarshal([]byte(spec), &commands); err != nil {
+		return nil, fmt.Errorf("commands should be a JSON array of argv lists - %w", err)
+	}
+	if err := validCommands(commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func validCommands(commands [][]string) error {
+	for i, argv := range commands {
+		if len(argv) == 0 || argv[0] == "" {
+			return fmt.Errorf("command %d is empty", i)
+		}
+	}
+	return nil
+}
+
+// runCommand runs argv in its own process group and kills the whole group on
+// timeout, so background children holding stdout can't block the collector.
+func runCommand(parentCtx context.Context, argv []string, timeout time.Duration) ([]byte, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = &out
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return nil, fmt.Errorf("command timed out after %v", timeout)
+	}
+}
+
+// parseExecOutput accepts either JSON in the same shape as the /updates/
+// request body (a single object or an array), or plain text with one
+// "name type value" line per metric.
+func parseExecOutput(out []byte) (*metrics.Metrics, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && (out[0] == '[' || out[0] == '{') {
+		return parseExecJSON(out)
+	}
+
+	prm := metrics.New()
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %q: expected `name type value`", line)
+		}
+		if err := putParsed(prm, fields[0], fields[1], fields[2]); err != nil {
+			return nil, fmt.Errorf("line %q: %w", line, err)
+		}
+	}
+	return prm, scanner.Err()
+}
+
+func parseExecJSON(out []byte) (*metrics.Metrics, error) {
+	type metric struct {
+		ID    string   `json:"id"`
+		MType string   `json:"type"`
+		Delta *int64   `json:"delta"`
+		Value *float64 `json:"value"`
+	}
+
+	var ms []metric
+	if out[0] == '{' {
+		out = append(append([]byte{'['}, out...), ']')
+	}
+	if err := json.Unmarshal(out, &ms); err != nil {
+		return nil, err
+	}
+
+	prm := metrics.New()
+	for _, m := range ms {
+		switch {
+		case m.MType == metrics.TypeGauge && m.Value != nil:
+			prm.Gauges[metrics.Name(m.ID)] = metrics.Gauge(*m.Value)
+		case m.MType == metrics.TypeCounter && m.Delta != nil:
+			prm.Counters[metrics.Name(m.ID)] += metrics.Counter(*m.Delta)
+		default:
+			return nil, fmt.Errorf("metric %q: invalid type or empty value", m.ID)
+		}
+	}
+	return prm, nil
+}
+
+func putParsed(prm *metrics.Metrics, name, mtype, value string) error {
+	switch mtype {
+	case metrics.TypeGauge:
+		var gauge metrics.Gauge
+		if err := gauge.FromString(value); err != nil {
+			return err
+		}
+		prm.Gauges[metrics.Name(name)] = gauge
+	case metrics.TypeCounter:
+		var counter metrics.Counter
+		if err := counter.FromString(value); err != nil {
+			return err
+		}
+		prm.Counters[metrics.Name(name)] += counter
+	default:
+		return fmt.Errorf("unknown metric type %q", mtype)
+	}
+	return nil
+}
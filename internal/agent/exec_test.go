@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseExecOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    *metrics.Metrics
+		wantErr bool
+	}{
+		{
+			name:   "Plain text",
+			output: "# queue check\nQueueDepth gauge 12.5\nProcessed counter 3\nProcessed counter 2\n",
+			want: &metrics.Metrics{
+				Gauges:   map[metrics.Name]metrics.Gauge{"QueueDepth": 12.5},
+				Counters: map[metrics.Name]metrics.Counter{"Processed": 5},
+			},
+		},
+		{
+			name:   "JSON array",
+			output: `[{"id":"CertExpiry","type":"gauge","value":86400},{"id":"Checks","type":"counter","delta":1}]`,
+			want: &metrics.Metrics{
+				Gauges:   map[metrics.Name]metrics.Gauge{"CertExpiry": 86400},
+				Counters: map[metrics.Name]metrics.Counter{"Checks": 1},
+			},
+		},
+		{
+			name:   "JSON object",
+			output: `{"id":"CertExpiry","type":"gauge","value":10}`,
+			want: &metrics.Metrics{
+				Gauges:   map[metrics.Name]metrics.Gauge{"CertExpiry": 10},
+				Counters: map[metrics.Name]metrics.Counter{},
+			},
+		},
+		{
+			name:    "Unknown type",
+			output:  "QueueDepth histogram 1",
+			wantErr: true,
+		},
+		{
+			name:    "Bad value",
+			output:  "Processed counter 1.5",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExecOutput([]byte(tt.output))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Gauges, got.Gauges)
+			assert.Equal(t, tt.want.Counters, got.Counters)
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	out, err := runCommand(context.Background(), []string{"sh", "-c", "echo 'Up gauge 1'"}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Up gauge 1\n", string(out))
+
+	start := time.Now()
+	_, err = runCommand(context.Background(), []string{"sleep", "5"}, 100*time.Millisecond)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// a background grandchild keeps stdout open after the script exits
+	start = time.Now()
+	_, err = runCommand(context.Background(), []string{"sh", "-c", "sleep 5 & echo Up gauge 1"}, 100*time.Millisecond)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestParseCommands(t *testing.T) {
+	commands, err := ParseCommands(`[["/opt/checks/cert.sh","example.com"],["sh","-c","echo \"Up gauge 1\""]]`)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"/opt/checks/cert.sh", "example.com"},
+		{"sh", "-c", `echo "Up gauge 1"`},
+	}, commands)
+
+	commands, err = ParseCommands("")
+	require.NoError(t, err)
+	assert.Empty(t, commands)
+
+	_, err = ParseCommands("/opt/checks/cert.sh")
+	require.Error(t, err)
+
+	_, err = ParseCommands(`[[]]`)
+	require.Error(t, err)
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+	ProbeDNS  = "dns"
+)
+
+type Probe struct {
+	Label  string
+	Kind   string
+	Target string
+}
+
+// ParseProbes parses "label=kind:target,..." where kind is http, tcp or dns,
+// e.g. "site=http:https://example.com,db=tcp:10.0.0.5:5432,ns=dns:example.com".
+func ParseProbes(spec string) ([]Probe, error) {
+	var probes []Probe
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		label, rule, ok := strings.Cut(entry, "=")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("probe %q: expected label=kind:target", entry)
+		}
+		kind, target, ok := strings.Cut(rule, ":")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("probe %q: expected label=kind:target", entry)
+		}
+
+		p := Probe{Label: label, Kind: kind, Target: target}
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+func (p Probe) validate() error {
+	if p.Label == "" || p.Target == "" {
+		return fmt.Errorf("probe %q: label and target should be set", p.Label)
+	}
+	switch p.Kind {
+	case ProbeHTTP, ProbeTCP, ProbeDNS:
+		return nil
+	}
+	return fmt.Errorf("probe %s: unknown kind %q", p.Label, p.Kind)
+}
+
+func (a *Agent) ProbeTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	ticker := time.NewTicker(a.pollInterval())
+	for {
+		select {
+		case <-ticker.C:
+			a.probeUpdate(ctx, metricsCh)
+		case <-ctx.Done():
+			log.Println("Regular completion of the probes")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// probeUpdate runs all probes concurrently, so a poll takes at most
+// config.Timeout however many targets are down.
+func (a *Agent) probeUpdate(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	results := make([]*metrics.Metrics, len(config.Probes))
+
+	var wg sync.WaitGroup
+	for i, p := range config.Probes {
+		results[i] = metrics.New()
+		wg.Add(1)
+		go func(p Probe, prm *metrics.Metrics) {
+			defer wg.Done()
+			a.runProbe(ctx, p, prm)
+		}(p, results[i])
+	}
+	wg.Wait()
+
+	prm := metrics.New()
+	for _, r := range results {
+		prm.Merge(*r)
+	}
+
+	metricsCh <- *prm
+
+	log.Println("Probes completed")
+}
+
+func (a *Agent) runProbe(parentCtx context.Context, p Probe, prm *metrics.Metrics) {
+	ctx, cancel := context.WithTimeout(parentCtx, config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	var err error
+
+	switch p.Kind {
+	case ProbeHTTP:
+		var status int
+		status, err = a.probeHTTP(ctx, p.Target)
+		prm.Gauges[deviceName(metrics.ProbeHTTPStatusCode, p.Label)] = metrics.Gauge(status)
+		if err == nil && (status < 200 || status >= 400) {
+			err = fmt.Errorf("status code %d", status)
+		}
+	case ProbeTCP:
+		var conn net.Conn
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", p.Target)
+		if err == nil {
+			conn.Close()
+		}
+	case ProbeDNS:
+		_, err = net.DefaultResolver.LookupHost(ctx, p.Target)
+	}
+
+	duration := time.Since(start).Seconds()
+	prm.Gauges[deviceName(probeDurationName(p.Kind), p.Label)] = metrics.Gauge(duration)
+
+	if err != nil {
+		a.handleError(fmt.Errorf("probe %s failed - %w", p.Label, err))
+		prm.Gauges[deviceName(metrics.ProbeSuccess, p.Label)] = 0
+		prm.Counters[deviceName(metrics.ProbeFailures, p.Label)] = 1
+		return
+	}
+	prm.Gauges[deviceName(metrics.ProbeSuccess, p.Label)] = 1
+}
+
+func (a *Agent) probeHTTP(ctx context.Context, url string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := a.client.GetClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func probeDurationName(kind string) metrics.Name {
+	switch kind {
+	case ProbeHTTP:
+		return metrics.ProbeHTTPDuration
+	case ProbeTCP:
+		return metrics.ProbeTCPDuration
+	}
+	return metrics.ProbeDNSDuration
+}
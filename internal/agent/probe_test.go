@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgent_runProbe(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "127.0.0.1:8080",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		probe   Probe
+		success metrics.Gauge
+		status  metrics.Gauge
+	}{
+		{
+			name:    "HTTP ok",
+			probe:   Probe{Label: "ok", Kind: ProbeHTTP, Target: ok.URL},
+			success: 1,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "HTTP unavailable",
+			probe:   Probe{Label: "broken", Kind: ProbeHTTP, Target: broken.URL},
+			success: 0,
+			status:  http.StatusServiceUnavailable,
+		},
+		{
+			name:    "TCP open",
+			probe:   Probe{Label: "open", Kind: ProbeTCP, Target: strings.TrimPrefix(ok.URL, "http://")},
+			success: 1,
+		},
+		{
+			name:    "TCP closed",
+			probe:   Probe{Label: "closed", Kind: ProbeTCP, Target: closedAddr},
+			success: 0,
+		},
+		{
+			name:    "DNS localhost",
+			probe:   Probe{Label: "local", Kind: ProbeDNS, Target: "localhost"},
+			success: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prm := metrics.New()
+			a.runProbe(context.Background(), tt.probe, prm)
+
+			assert.Equal(t, tt.success, prm.Gauges[deviceName(metrics.ProbeSuccess, tt.probe.Label)])
+			assert.Contains(t, prm.Gauges, deviceName(probeDurationName(tt.probe.Kind), tt.probe.Label))
+			if tt.probe.Kind == ProbeHTTP {
+				assert.Equal(t, tt.status, prm.Gauges[deviceName(metrics.ProbeHTTPStatusCode, tt.probe.Label)])
+			}
+		})
+	}
+}
+
+func TestParseProbes(t *testing.T) {
+	probes, err := ParseProbes("site=http:https://example.com/health,db=tcp:10.0.0.5:5432")
+	require.NoError(t, err)
+	assert.Equal(t, []Probe{
+		{Label: "site", Kind: ProbeHTTP, Target: "https://example.com/health"},
+		{Label: "db", Kind: ProbeTCP, Target: "10.0.0.5:5432"},
+	}, probes)
+
+	_, err = ParseProbes("site=icmp:example.com")
+	require.Error(t, err)
+}
+
+func TestAgent_probeUpdateConcurrent(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	var probes []Probe
+	for _, label := range []string{"a", "b", "c", "d", "e"} {
+		probes = append(probes, Probe{Label: label, Kind: ProbeHTTP, Target: slow.URL})
+	}
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "127.0.0.1:8080",
+		Probes:         probes,
+	})
+	require.NoError(t, err)
+
+	metricsCh := make(chan metrics.Metrics, 1)
+	start := time.Now()
+	a.probeUpdate(context.Background(), metricsCh)
+	assert.Less(t, time.Since(start), time.Second)
+
+	prm := <-metricsCh
+	for _, p := range probes {
+		assert.Equal(t, metrics.Gauge(1), prm.Gauges[deviceName(metrics.ProbeSuccess, p.Label)])
+	}
+}
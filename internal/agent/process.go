@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/shirou/gopsutil/process"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MatchPidFile = "pidfile"
+	MatchName    = "name"
+	MatchCmdline = "cmdline"
+)
+
+type ProcessConfig struct {
+	Label   string
+	Match   string
+	Pattern string
+}
+
+type processWatch struct {
+	ProcessConfig
+	re    *regexp.Regexp
+	procs map[int32]*process.Process
+	lost  int
+}
+
+// ParseProcesses parses a list of watched processes in the form
+// "label=kind:pattern;label=kind:pattern", where kind is pidfile, name or cmdline.
+func ParseProcesses(spec string) ([]ProcessConfig, error) {
+	var pcs []ProcessConfig
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		label, rule, ok := strings.Cut(entry, "=")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("process %q: expected label=kind:pattern", entry)
+		}
+		kind, pattern, ok := strings.Cut(rule, ":")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("process %q: expected label=kind:pattern", entry)
+		}
+
+		pcs = append(pcs, ProcessConfig{Label: label, Match: kind, Pattern: pattern})
+	}
+	return pcs, nil
+}
+
+func newProcessWatches(pcs []ProcessConfig) ([]*processWatch, error) {
+	watches := make([]*processWatch, 0, len(pcs))
+	for _, pc := range pcs {
+		w, err := newProcessWatch(pc)
+		if err != nil {
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+	return watches, nil
+}
+
+func newProcessWatch(pc ProcessConfig) (*processWatch, error) {
+	w := &processWatch{
+		ProcessConfig: pc,
+		procs:         make(map[int32]*process.Process),
+	}
+
+	switch pc.Match {
+	case MatchPidFile, MatchName:
+	case MatchCmdline:
+		re, err := regexp.Compile(pc.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: %w", pc.Label, err)
+		}
+		w.re = re
+	default:
+		return nil, fmt.Errorf("process %s: unknown match kind %q", pc.Label, pc.Match)
+	}
+	return w, nil
+}
+
+// listProcesses is replaced in tests.
+var listProcesses = process.Processes
+
+func (a *Agent) ProcessTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	ticker := time.NewTicker(a.pollInterval())
+	for {
+		select {
+		case <-ticker.C:
+			a.processUpdate(metricsCh)
+		case <-ctx.Done():
+			log.Println("Regular completion of the process metrics update")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (a *Agent) processUpdate(metricsCh chan<- metrics.Metrics) {
+	prm := metrics.New()
+
+	var all []*process.Process
+	var listErr error
+	listed := false
+	for _, w := range a.processes {
+		if w.Match != MatchPidFile {
+			// Only the watches that search the process list are skipped
+			// when it can't be read, pidfile watches don't need it.
+			if !listed {
+				all, listErr = listProcesses()
+				listed = true
+				if listErr != nil {
+					a.handleError(fmt.Errorf("error listing processes via `gopsutil` package - %w", listErr))
+				}
+			}
+			if listErr != nil {
+				continue
+			}
+		}
+		w.update(a, all, prm)
+	}
+
+	metricsCh <- *prm
+
+	log.Println("Process metrics updated")
+}
+
+func (w *processWatch) update(a *Agent, all []*process.Process, prm *metrics.Metrics) {
+	pids, err := w.find(all)
+	if err != nil {
+		a.handleError(err)
+	}
+
+	var cpu float64
+	var rss uint64
+	var fds, threads int32
+	current := make(map[int32]*process.Process, len(pids))
+
+	for _, pid := range pids {
+		p, ok := w.procs[pid]
+		if !ok {
+			p, err = process.NewProcess(pid)
+			if err != nil {
+				continue
+			}
+		}
+		current[pid] = p
+
+		if v, err := p.Percent(0); err == nil {
+			cpu += v
+		}
+		if v, err := p.MemoryInfo(); err == nil {
+			rss += v.RSS
+		}
+		if v, err := p.NumFDs(); err == nil {
+			fds += v
+		}
+		if v, err := p.NumThreads(); err == nil {
+			threads += v
+		}
+	}
+
+	var gone, started int
+	for pid := range w.procs {
+		if _, ok := current[pid]; !ok {
+			gone++
+		}
+	}
+	for pid := range current {
+		if _, ok := w.procs[pid]; !ok {
+			started++
+		}
+	}
+	w.procs = current
+
+	// A process that vanished is counted as restarted once a match shows up
+	// again, even if that happens several polls later.
+	w.lost += gone
+	restarts := w.lost
+	if started < restarts {
+		restarts = started
+	}
+	w.lost -= restarts
+
+	prm.Gauges[deviceName(metrics.ProcessCount, w.Label)] = metrics.Gauge(len(current))
+	prm.Gauges[deviceName(metrics.ProcessCPU, w.Label)] = metrics.Gauge(cpu)
+	prm.Gauges[deviceName(metrics.ProcessRSS, w.Label)] = metrics.Gauge(rss)
+	prm.Gauges[deviceName(metrics.ProcessFDs, w.Label)] = metrics.Gauge(fds)
+	prm.Gauges[deviceName(metrics.ProcessThreads, w.Label)] = metrics.Gauge(threads)
+	prm.Counters[deviceName(metrics.ProcessRestarts, w.Label)] = metrics.Counter(restarts)
+}
+
+func (w *processWatch) find(all []*process.Process) ([]int32, error) {
+	if w.Match == MatchPidFile {
+		data, err := os.ReadFile(w.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: %w", w.Label, err)
+		}
+		pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("process %s: invalid pid file - %w", w.Label, err)
+		}
+		if ok, _ := process.PidExists(int32(pid)); !ok {
+			return nil, nil
+		}
+		return []int32{int32(pid)}, nil
+	}
+
+	var pids []int32
+	for _, p := range all {
+		if w.matches(p) {
+			pids = append(pids, p.Pid)
+		}
+	}
+	return pids, nil
+}
+
+func (w *processWatch) matches(p *process.Process) bool {
+	switch w.Match {
+	case MatchName:
+		name, err := p.Name()
+		return err == nil && name == w.Pattern
+	case MatchCmdline:
+		cmdline, err := p.Cmdline()
+		return err == nil && w.re.MatchString(cmdline)
+	}
+	return false
+}
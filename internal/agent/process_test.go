@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"errors"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/shirou/gopsutil/process"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseProcesses(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []ProcessConfig
+		wantErr bool
+	}{
+		{
+			name: "Empty spec",
+			spec: "",
+		},
+		{
+			name: "Several processes",
+			spec: "nginx=pidfile:/run/nginx.pid; db=name:postgres;worker=cmdline:app --worker=\\d+",
+			want: []ProcessConfig{
+				{Label: "nginx", Match: MatchPidFile, Pattern: "/run/nginx.pid"},
+				{Label: "db", Match: MatchName, Pattern: "postgres"},
+				{Label: "worker", Match: MatchCmdline, Pattern: "app --worker=\\d+"},
+			},
+		},
+		{
+			name:    "Missing label",
+			spec:    "name:postgres",
+			wantErr: true,
+		},
+		{
+			name:    "Missing pattern",
+			spec:    "db=name:",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProcesses(tt.spec)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestProcessWatch_update(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "agent.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644))
+
+	w, err := newProcessWatch(ProcessConfig{Label: "self", Match: MatchPidFile, Pattern: pidFile})
+	require.NoError(t, err)
+
+	prm := metrics.New()
+	w.update(&Agent{}, nil, prm)
+
+	assert.Equal(t, metrics.Gauge(1), prm.Gauges["ProcessCount_self"])
+	assert.Greater(t, float64(prm.Gauges["ProcessRSS_self"]), 0.0)
+	assert.Greater(t, float64(prm.Gauges["ProcessThreads_self"]), 0.0)
+	assert.Equal(t, metrics.Counter(0), prm.Counters["ProcessRestarts_self"])
+}
+
+func TestProcessWatch_restarts(t *testing.T) {
+	startChild := func() *exec.Cmd {
+		cmd := exec.Command("sleep", "30")
+		require.NoError(t, cmd.Start())
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		return cmd
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "daemon.pid")
+	writePid := func(pid int) {
+		require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644))
+	}
+
+	w, err := newProcessWatch(ProcessConfig{Label: "daemon", Match: MatchPidFile, Pattern: pidFile})
+	require.NoError(t, err)
+
+	poll := func() (metrics.Gauge, metrics.Counter) {
+		prm := metrics.New()
+		w.update(&Agent{}, nil, prm)
+		return prm.Gauges["ProcessCount_daemon"], prm.Counters["ProcessRestarts_daemon"]
+	}
+
+	first := startChild()
+	writePid(first.Process.Pid)
+	count, restarts := poll()
+	assert.Equal(t, metrics.Gauge(1), count)
+	assert.Equal(t, metrics.Counter(0), restarts)
+
+	// the daemon crashed and is restarted only after the next poll
+	first.Process.Kill()
+	first.Wait()
+	count, restarts = poll()
+	assert.Equal(t, metrics.Gauge(0), count)
+	assert.Equal(t, metrics.Counter(0), restarts)
+
+	second := startChild()
+	writePid(second.Process.Pid)
+	count, restarts = poll()
+	assert.Equal(t, metrics.Gauge(1), count)
+	assert.Equal(t, metrics.Counter(1), restarts)
+
+	count, restarts = poll()
+	assert.Equal(t, metrics.Gauge(1), count)
+	assert.Equal(t, metrics.Counter(0), restarts)
+}
+
+func TestAgent_processUpdateListError(t *testing.T) {
+	listProcesses = func() ([]*process.Process, error) {
+		return nil, errors.New("no /proc")
+	}
+	t.Cleanup(func() { listProcesses = process.Processes })
+
+	pidFile := filepath.Join(t.TempDir(), "agent.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644))
+
+	byName, err := newProcessWatch(ProcessConfig{Label: "db", Match: MatchName, Pattern: "postgres"})
+	require.NoError(t, err)
+	byPidFile, err := newProcessWatch(ProcessConfig{Label: "self", Match: MatchPidFile, Pattern: pidFile})
+	require.NoError(t, err)
+
+	a := &Agent{processes: []*processWatch{byName, byPidFile}}
+	metricsCh := make(chan metrics.Metrics, 1)
+	a.processUpdate(metricsCh)
+	prm := <-metricsCh
+
+	assert.NotContains(t, prm.Gauges, metrics.Name("ProcessCount_db"))
+	assert.Equal(t, metrics.Gauge(1), prm.Gauges["ProcessCount_self"])
+}
@@ -0,0 +1,322 @@
+// Package queue keeps metric batches the agent could not deliver in segment
+// files on disk, so they survive server outages and agent restarts.
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt = ".seg"
+
+	DefaultSegmentSize = 1 << 20
+	DefaultMaxSize     = 64 << 20
+	DefaultMaxAge      = 24 * time.Hour
+)
+
+type Config struct {
+	Dir         string
+	SegmentSize int64
+	MaxSize     int64
+	MaxAge      time.Duration
+}
+
+type Queue struct {
+	cfg Config
+
+	mu       sync.Mutex
+	segments []uint64
+	inflight map[uint64]bool
+	active   *os.File
+	size     int64
+}
+
+func New(cfg Config) (*Queue, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("queue directory is not set")
+	}
+	if cfg.SegmentSize == 0 {
+		cfg.SegmentSize = DefaultSegmentSize
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.MaxSize < cfg.SegmentSize {
+		return nil, fmt.Errorf("queue max size %d is less than segment size %d", cfg.MaxSize, cfg.SegmentSize)
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{cfg: cfg}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	return q, nil
+}
+
+// Push appends a batch to the active segment, starting a new segment when
+// the active one is full, and enforces the size and age limits.
+func (q *Queue) Push(m metrics.Metrics) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.push(m); err != nil {
+		return err
+	}
+	return q.trim()
+}
+
+func (q *Queue) push(m metrics.Metrics) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if q.active == nil || q.size+int64(len(data)) > q.cfg.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := q.active.Write(data)
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return q.active.Sync()
+}
+
+func (q *Queue) rotate() error {
+	if err := q.seal(); err != nil {
+		return err
+	}
+
+	var seq uint64 = 1
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(q.path(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.active = f
+	q.size = 0
+	q.segments = append(q.segments, seq)
+	return nil
+}
+
+func (q *Queue) seal() error {
+	if q.active == nil {
+		return nil
+	}
+	err := q.active.Close()
+	q.active = nil
+	q.size = 0
+	return err
+}
+
+// trim drops the oldest segments while the queue is over its size or age
+// limit. Counters of the dropped segments are merged and pushed back as one
+// record, so only gauge values are lost.
+func (q *Queue) trim() error {
+	total := q.totalSize()
+	dropped := metrics.Metrics{}
+	var gauges int
+
+	for len(q.segments) > 1 {
+		oldest := q.segments[0]
+		if q.inflight[oldest] {
+			break
+		}
+		info, err := os.Stat(q.path(oldest))
+		if err != nil {
+			return err
+		}
+
+		if total <= q.cfg.MaxSize && time.Since(info.ModTime()) <= q.cfg.MaxAge {
+			break
+		}
+
+		m, err := q.read(oldest)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(q.path(oldest)); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+		total -= info.Size()
+		gauges += len(m.Gauges)
+		dropped.Merge(metrics.Metrics{Counters: m.Counters})
+		log.Printf("queue: segment %d dropped", oldest)
+	}
+
+	if gauges > 0 {
+		log.Printf("queue: %d gauge values lost", gauges)
+	}
+	if len(dropped.Counters) > 0 {
+		return q.push(metrics.Metrics{Counters: dropped.Counters})
+	}
+	return nil
+}
+
+func (q *Queue) totalSize() int64 {
+	var total int64
+	for _, seq := range q.segments {
+		if info, err := os.Stat(q.path(seq)); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// Drain seals the active segment and returns everything queued so far merged
+// into one batch, together with the segments it was read from. Segments
+// drained by another caller and not yet removed or released are skipped. The
+// caller removes them with Remove once the batch is delivered.
+func (q *Queue) Drain() (metrics.Metrics, []uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	merged := *metrics.New()
+	if err := q.seal(); err != nil {
+		return merged, nil, err
+	}
+
+	var segments []uint64
+	for _, seq := range q.segments {
+		if q.inflight[seq] {
+			continue
+		}
+		m, err := q.read(seq)
+		if err != nil {
+			return merged, nil, err
+		}
+		merged.Merge(m)
+		segments = append(segments, seq)
+	}
+
+	if q.inflight == nil {
+		q.inflight = make(map[uint64]bool, len(segments))
+	}
+	for _, seq := range segments {
+		q.inflight[seq] = true
+	}
+	return merged, segments, nil
+}
+
+func (q *Queue) Remove(segments []uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := make(map[uint64]bool, len(segments))
+	for _, seq := range segments {
+		if err := os.Remove(q.path(seq)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed[seq] = true
+		delete(q.inflight, seq)
+	}
+
+	kept := q.segments[:0]
+	for _, seq := range q.segments {
+		if !removed[seq] {
+			kept = append(kept, seq)
+		}
+	}
+	q.segments = kept
+	return nil
+}
+
+// Release returns drained segments that could not be delivered to the queue,
+// so they are subject to the size and age limits again.
+func (q *Queue) Release(segments []uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, seq := range segments {
+		delete(q.inflight, seq)
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.segments)
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.seal()
+}
+
+func (q *Queue) read(seq uint64) (metrics.Metrics, error) {
+	merged := *metrics.New()
+
+	f, err := os.Open(q.path(seq))
+	if err != nil {
+		return merged, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var m metrics.Metrics
+			if err := json.Unmarshal(line, &m); err != nil {
+				// A torn write at the end of a segment after a crash.
+				log.Printf("queue: skipping corrupted record in segment %d - %v", seq, err)
+			} else {
+				merged.Merge(m)
+			}
+		}
+		if err == io.EOF {
+			return merged, nil
+		}
+		if err != nil {
+			return merged, err
+		}
+	}
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.cfg.Dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
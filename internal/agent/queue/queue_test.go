@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func batch(gauge metrics.Gauge, counter metrics.Counter) metrics.Metrics {
+	return metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{metrics.Alloc: gauge},
+		Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: counter},
+	}
+}
+
+func TestQueue_DrainAndRemove(t *testing.T) {
+	dir := t.TempDir()
+	q, err := New(Config{Dir: dir, SegmentSize: 64})
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, q.Push(batch(metrics.Gauge(i), 1)))
+	}
+	assert.Greater(t, q.Len(), 1, "small segment size should rotate segments")
+
+	m, segments, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(5), m.Gauges[metrics.Alloc])
+	assert.Equal(t, metrics.Counter(5), m.Counters[metrics.PollCount])
+
+	require.NoError(t, q.Push(batch(6, 1)))
+	require.NoError(t, q.Remove(segments))
+	assert.Equal(t, 1, q.Len())
+
+	m, _, err = q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(6), m.Gauges[metrics.Alloc])
+	assert.Equal(t, metrics.Counter(1), m.Counters[metrics.PollCount])
+}
+
+func TestQueue_DrainSkipsInflight(t *testing.T) {
+	q, err := New(Config{Dir: t.TempDir(), SegmentSize: 64})
+	require.NoError(t, err)
+
+	require.NoError(t, q.Push(batch(1, 1)))
+	first, firstSegments, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(1), first.Counters[metrics.PollCount])
+
+	require.NoError(t, q.Push(batch(2, 2)))
+	second, secondSegments, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), second.Counters[metrics.PollCount])
+	assert.NotContains(t, secondSegments, firstSegments[0])
+
+	// Releasing one drain keeps the segments of the other in flight.
+	q.Release(secondSegments)
+	third, thirdSegments, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), third.Counters[metrics.PollCount])
+	assert.Equal(t, secondSegments, thirdSegments)
+
+	require.NoError(t, q.Remove(firstSegments))
+	require.NoError(t, q.Remove(thirdSegments))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestQueue_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := New(Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, q.Push(batch(1, 2)))
+	require.NoError(t, q.Close())
+
+	// simulate a torn write left by a crash
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.seg"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Gauges":{"Al`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = New(Config{Dir: dir})
+	require.NoError(t, err)
+	require.NoError(t, q.Push(batch(3, 4)))
+
+	m, _, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(3), m.Gauges[metrics.Alloc])
+	assert.Equal(t, metrics.Counter(6), m.Counters[metrics.PollCount])
+}
+
+func TestQueue_TrimKeepsCounters(t *testing.T) {
+	dir := t.TempDir()
+	q, err := New(Config{Dir: dir, SegmentSize: 64, MaxSize: 200, MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	for i := 1; i <= 20; i++ {
+		require.NoError(t, q.Push(batch(metrics.Gauge(i), 1)))
+	}
+	assert.LessOrEqual(t, q.totalSize(), int64(200)+64)
+
+	m, _, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(20), m.Gauges[metrics.Alloc])
+	assert.Equal(t, metrics.Counter(20), m.Counters[metrics.PollCount])
+}
+
+func TestQueue_Limits(t *testing.T) {
+	_, err := New(Config{Dir: t.TempDir(), SegmentSize: 1024, MaxSize: 512})
+	require.Error(t, err)
+
+	q, err := New(Config{Dir: t.TempDir(), SegmentSize: 64, MaxSize: 128, MaxAge: time.Hour})
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, q.Push(batch(metrics.Gauge(i), 1)))
+	}
+
+	_, segments, err := q.Drain()
+	require.NoError(t, err)
+	q.Release(segments)
+
+	for i := 6; i <= 20; i++ {
+		require.NoError(t, q.Push(batch(metrics.Gauge(i), 1)))
+	}
+	assert.LessOrEqual(t, q.totalSize(), int64(128)+64, "released segments are trimmed again")
+
+	m, _, err := q.Drain()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(20), m.Counters[metrics.PollCount])
+}
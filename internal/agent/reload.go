@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"reflect"
+	"time"
+)
+
+// configTask is the supervisor name of the agent settings pull.
+const configTask = "config"
+
+// WithReload sets the function reading the config again on SIGHUP.
+func (a *Agent) WithReload(fn func() (Config, error)) {
+	a.reloadFn = fn
+}
+
+func (a *Agent) configTicker(ctx context.Context, _ chan<- metrics.Metrics) {
+	a.ConfigTicker(ctx)
+}
+
+func (a *Agent) reload() {
+	if a.reloadFn == nil {
+		return
+	}
+
+	cfg, err := a.reloadFn()
+	if err == nil {
+		err = a.Reload(cfg)
+	}
+	if err != nil {
+		a.handleError(fmt.Errorf("config is not reloaded - %w", err))
+		return
+	}
+	log.Println("Config reloaded")
+}
+
+// Reload applies cfg while the agent is running. Only the goroutines whose
+// settings changed are restarted: a collector when its own settings or the
+// poll interval change, the settings pull when the agent id, group or pull
+// interval change. Servers, key and aggregation are swapped in place. The
+// rate limit, timeouts and queue are set at start only.
+func (a *Agent) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	// Everything is built first, so a bad config leaves the agent as is.
+	var err error
+	var r *route
+	if !reflect.DeepEqual(cfg.Addresses, config.Addresses) || cfg.Strategy != config.Strategy || cfg.Key != config.Key || cfg.ID != config.ID {
+		if r, err = newRoute(cfg); err != nil {
+			return err
+		}
+	}
+	if err := validAggregations(cfg.Aggregation, cfg.GaugeAggregations); err != nil {
+		return err
+	}
+	var processes []*processWatch
+	if !reflect.DeepEqual(cfg.Processes, config.Processes) {
+		if processes, err = newProcessWatches(cfg.Processes); err != nil {
+			return err
+		}
+	}
+	var cgroups []cgroupWatch
+	if !reflect.DeepEqual(cfg.Cgroups, config.Cgroups) {
+		if cgroups, err = newCgroupWatches(cgroupRoot, cfg.Cgroups); err != nil {
+			return err
+		}
+	}
+
+	if cfg.RateLimit != config.RateLimit || cfg.Timeout != config.Timeout || cfg.Queue != config.Queue {
+		log.Println("Rate limit, timeout and queue changes take effect after restart")
+	}
+
+	configChanged := cfg.ID != config.ID || cfg.Group != config.Group || cfg.ConfigInterval != config.ConfigInterval
+	if configChanged && a.supervisor != nil {
+		a.supervisor.Stop(configTask)
+	}
+
+	a.applyMu.Lock()
+	defer a.applyMu.Unlock()
+
+	if r != nil {
+		a.routeMu.Lock()
+		a.route = r
+		config.Addresses, config.Address, config.Strategy, config.Key = cfg.Addresses, cfg.Address, cfg.Strategy, cfg.Key
+		a.routeMu.Unlock()
+	}
+	if err := a.aggregator.SetModes(cfg.Aggregation, cfg.GaugeAggregations); err != nil {
+		return err
+	}
+	config.Aggregation, config.GaugeAggregations = cfg.Aggregation, cfg.GaugeAggregations
+
+	// Intervals set by the server take precedence over the config.
+	pollChanged := cfg.PollInterval != config.PollInterval && a.settings.PollInterval == 0
+	if a.settings.ReportInterval == 0 {
+		a.setReportInterval(cfg.ReportInterval)
+	}
+	config.PollInterval, config.ReportInterval = cfg.PollInterval, cfg.ReportInterval
+	config.ShutdownTimeout = cfg.ShutdownTimeout
+
+	changed := map[string]bool{
+		agentconfig.CollectorProcess: processes != nil,
+		agentconfig.CollectorCgroup:  cgroups != nil,
+		agentconfig.CollectorExec:    !reflect.DeepEqual(cfg.Commands, config.Commands) || cfg.CommandTimeout != config.CommandTimeout,
+		agentconfig.CollectorScrape:  !reflect.DeepEqual(cfg.ScrapeTargets, config.ScrapeTargets),
+		agentconfig.CollectorProbe:   !reflect.DeepEqual(cfg.Probes, config.Probes),
+	}
+
+	// A collector is stopped before the settings it reads are replaced.
+	restart := make(map[string]bool)
+	for name, ok := range changed {
+		restart[name] = ok
+	}
+	if pollChanged {
+		for name := range a.collectors() {
+			restart[name] = true
+		}
+	}
+	for name, ok := range restart {
+		if ok {
+			a.stopCollector(name)
+		}
+	}
+
+	if pollChanged {
+		a.settingsMu.Lock()
+		a.pollEvery = cfg.PollInterval
+		a.settingsMu.Unlock()
+	}
+	if changed[agentconfig.CollectorProcess] {
+		a.processes, config.Processes = processes, cfg.Processes
+	}
+	if changed[agentconfig.CollectorCgroup] {
+		a.cgroups, config.Cgroups = cgroups, cfg.Cgroups
+	}
+	if changed[agentconfig.CollectorExec] {
+		config.Commands, config.CommandTimeout = cfg.Commands, cfg.CommandTimeout
+	}
+	if changed[agentconfig.CollectorScrape] {
+		config.ScrapeTargets = cfg.ScrapeTargets
+	}
+	if changed[agentconfig.CollectorProbe] {
+		config.Probes = cfg.Probes
+	}
+
+	collectors := a.collectors()
+	for name, ok := range restart {
+		if c, exists := collectors[name]; ok && exists && a.collectorEnabled(name) {
+			a.startCollector(name, c)
+		}
+	}
+
+	if configChanged {
+		config.ID, config.Group, config.ConfigInterval = cfg.ID, cfg.Group, cfg.ConfigInterval
+		if a.supervisor != nil && cfg.ConfigInterval > 0 {
+			a.supervisor.Start(configTask, a.configTicker)
+		}
+	}
+	return nil
+}
+
+// collectorEnabled tells whether the server-side settings allow the
+// collector to run.
+func (a *Agent) collectorEnabled(name string) bool {
+	enabled, ok := a.settings.Collectors[name]
+	return !ok || enabled
+}
+
+func (a *Agent) stopCollector(name string) {
+	if a.supervisor != nil {
+		a.supervisor.Stop(name)
+	}
+}
+
+func (a *Agent) startCollector(name string, c collector) {
+	if a.supervisor != nil {
+		a.supervisor.Start(name, c)
+	}
+}
+
+// setReportInterval passes the interval to RunReport, only the latest one
+// is kept if it didn't pick the previous one yet.
+func (a *Agent) setReportInterval(d time.Duration) {
+	if d == a.reportEvery {
+		return
+	}
+	a.reportEvery = d
+	select {
+	case <-a.reportEveryCh:
+	default:
+	}
+	a.reportEveryCh <- d
+}
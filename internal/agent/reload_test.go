@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAgent_Reload(t *testing.T) {
+	cfg := Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Hour,
+		ReportInterval: time.Hour,
+		Address:        "localhost:8080",
+	}
+	a, err := New(cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.supervisor = newSupervisor(ctx, make(chan metrics.Metrics, 10))
+	for name, c := range a.collectors() {
+		a.supervisor.Start(name, c)
+	}
+	defer func() {
+		cancel()
+		a.supervisor.Wait()
+	}()
+
+	task := func(name string) *task {
+		a.supervisor.mu.Lock()
+		defer a.supervisor.mu.Unlock()
+		return a.supervisor.running[name]
+	}
+	runtime := task(agentconfig.CollectorRuntime)
+
+	// A new collector starts, the others keep running.
+	cfg.Probes = []Probe{{Label: "db", Kind: ProbeTCP, Target: "localhost:1"}}
+	cfg.Key = "secret"
+	require.NoError(t, a.Reload(cfg))
+	assert.True(t, a.supervisor.Running(agentconfig.CollectorProbe))
+	assert.Same(t, runtime, task(agentconfig.CollectorRuntime))
+	assert.Equal(t, "secret", a.currentRoute().key)
+	assert.Empty(t, a.reportEveryCh)
+
+	// A new poll interval restarts every collector.
+	probe := task(agentconfig.CollectorProbe)
+	cfg.PollInterval = 30 * time.Second
+	cfg.ReportInterval = time.Minute
+	require.NoError(t, a.Reload(cfg))
+	assert.Equal(t, 30*time.Second, a.pollInterval())
+	assert.NotSame(t, runtime, task(agentconfig.CollectorRuntime))
+	assert.NotSame(t, probe, task(agentconfig.CollectorProbe))
+	assert.Equal(t, time.Minute, <-a.reportEveryCh)
+
+	// A bad config changes nothing.
+	bad := cfg
+	bad.Strategy = "random"
+	bad.Probes = nil
+	assert.Error(t, a.Reload(bad))
+	assert.True(t, a.supervisor.Running(agentconfig.CollectorProbe))
+
+	// A removed collector stops.
+	cfg.Probes = nil
+	require.NoError(t, a.Reload(cfg))
+	assert.False(t, a.supervisor.Running(agentconfig.CollectorProbe))
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// collectors returns the collectors this agent is configured for by name.
+func (a *Agent) collectors() map[string]collector {
+	c := map[string]collector{
+		agentconfig.CollectorRuntime:  a.RunPool,
+		agentconfig.CollectorGopsutil: a.GopsutilTicker,
+	}
+	if len(a.processes) > 0 {
+		c[agentconfig.CollectorProcess] = a.ProcessTicker
+	}
+	if len(a.cgroups) > 0 {
+		c[agentconfig.CollectorCgroup] = a.CgroupTicker
+	}
+	if len(config.Commands) > 0 {
+		c[agentconfig.CollectorExec] = a.ExecTicker
+	}
+	if len(config.ScrapeTargets) > 0 {
+		c[agentconfig.CollectorScrape] = a.ScrapeTicker
+	}
+	if len(config.Probes) > 0 {
+		c[agentconfig.CollectorProbe] = a.ProbeTicker
+	}
+	return c
+}
+
+func (a *Agent) pollInterval() time.Duration {
+	a.settingsMu.Lock()
+	defer a.settingsMu.Unlock()
+	return a.pollEvery
+}
+
+// ConfigTicker pulls the agent settings from the server and applies them.
+func (a *Agent) ConfigTicker(ctx context.Context) {
+	a.pullSettings(ctx)
+
+	ticker := time.NewTicker(config.ConfigInterval)
+	for {
+		select {
+		case <-ticker.C:
+			a.pullSettings(ctx)
+		case <-ctx.Done():
+			log.Println("Regular completion of the agent config update")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (a *Agent) pullSettings(ctx context.Context) {
+	var err error
+	for _, e := range a.currentRoute().endpoints {
+		var s agentconfig.Settings
+		s, err = a.fetchSettings(ctx, e.address)
+		if err == nil {
+			a.applySettings(s)
+			return
+		}
+	}
+	a.handleError(fmt.Errorf("could not get agent config - %w", err))
+}
+
+// fetchSettings returns empty settings when the server has none for the
+// agent, so the agent goes back to its own configuration.
+func (a *Agent) fetchSettings(ctx context.Context, address string) (agentconfig.Settings, error) {
+	var s agentconfig.Settings
+
+	resp, err := a.client.R().
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		SetQueryParams(map[string]string{"id": config.ID, "group": config.Group}).
+		Get(fmt.Sprintf("http://%s/agent-config", address))
+	if err != nil {
+		return s, err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		err = json.Unmarshal(resp.Body(), &s)
+		return s, err
+	case http.StatusNotFound:
+		return s, nil
+	}
+	return s, fmt.Errorf("invalid status code %v", resp.StatusCode())
+}
+
+// applySettings restarts the collectors when the poll interval changes and
+// starts or stops the ones switched on or off. Collectors that aren't
+// mentioned in s keep running.
+func (a *Agent) applySettings(s agentconfig.Settings) {
+	a.applyMu.Lock()
+	defer a.applyMu.Unlock()
+
+	if reflect.DeepEqual(s, a.settings) {
+		return
+	}
+	a.settings = s
+
+	poll := config.PollInterval
+	if s.PollInterval > 0 {
+		poll = time.Duration(s.PollInterval) * time.Second
+	}
+	report := config.ReportInterval
+	if s.ReportInterval > 0 {
+		report = time.Duration(s.ReportInterval) * time.Second
+	}
+
+	a.settingsMu.Lock()
+	pollChanged := poll != a.pollEvery
+	a.pollEvery = poll
+	a.settingsMu.Unlock()
+
+	a.setReportInterval(report)
+
+	if a.supervisor != nil {
+		for name, c := range a.collectors() {
+			switch {
+			case !a.collectorEnabled(name):
+				a.supervisor.Stop(name)
+			case pollChanged:
+				a.supervisor.Stop(name)
+				a.supervisor.Start(name, c)
+			default:
+				a.supervisor.Start(name, c)
+			}
+		}
+	}
+
+	log.Printf("Agent settings applied: poll interval %v, report interval %v, collectors %v", poll, report, s.Collectors)
+}
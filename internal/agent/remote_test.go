@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/internal/server/handlers"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgent_applySettings(t *testing.T) {
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Hour,
+		ReportInterval: time.Hour,
+		Address:        "localhost:8080",
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.supervisor = newSupervisor(ctx, make(chan metrics.Metrics, 10))
+	for name, c := range a.collectors() {
+		a.supervisor.Start(name, c)
+	}
+	defer func() {
+		cancel()
+		a.supervisor.Wait()
+	}()
+
+	a.applySettings(agentconfig.Settings{
+		PollInterval: 30,
+		Collectors:   map[string]bool{agentconfig.CollectorGopsutil: false},
+	})
+	assert.Equal(t, 30*time.Second, a.pollInterval())
+	assert.False(t, a.supervisor.Running(agentconfig.CollectorGopsutil))
+	assert.True(t, a.supervisor.Running(agentconfig.CollectorRuntime))
+	assert.Empty(t, a.reportEveryCh)
+
+	a.applySettings(agentconfig.Settings{ReportInterval: 5})
+	assert.Equal(t, time.Hour, a.pollInterval(), "the agent's own poll interval is back")
+	assert.True(t, a.supervisor.Running(agentconfig.CollectorGopsutil))
+	assert.Equal(t, 5*time.Second, <-a.reportEveryCh)
+}
+
+func TestAgent_pullSettings(t *testing.T) {
+	h := handlers.New(chi.NewRouter(), nil, "", false, "")
+	h.WithAgentConfig(&agentconfig.File{
+		Agents: map[string]agentconfig.Settings{"web-1": {PollInterval: 7}},
+	})
+	server := httptest.NewServer(h.GetRouter())
+	defer server.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Hour,
+		ReportInterval: time.Hour,
+		Addresses:      []string{"localhost:1", strings.TrimPrefix(server.URL, "http://")},
+		ID:             "web-1",
+	})
+	require.NoError(t, err)
+
+	a.pullSettings(context.Background())
+	assert.Equal(t, 7*time.Second, a.pollInterval())
+}
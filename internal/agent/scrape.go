@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ScrapeTarget struct {
+	Label string
+	URL   string
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.:-]+`)
+
+// ParseScrapeTargets parses "url,label=url,..." into scrape targets. Samples
+// of a target are reported with the "<label>_" prefix; without a label the
+// target's host and port are used, e.g. "localhost_9100_".
+//
+// A target exposes either the Prometheus text format or JSON in the form
+// {"gauges":{"name":1.5},"counters":{"name":42}}. In both formats counters
+// are cumulative totals, the agent sends their increments between scrapes.
+func ParseScrapeTargets(spec string) []ScrapeTarget {
+	var targets []ScrapeTarget
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		label, target, ok := strings.Cut(entry, "=")
+		if !ok || label == "" || strings.Contains(label, "/") {
+			label, target = defaultScrapeLabel(entry), entry
+		}
+		targets = append(targets, ScrapeTarget{Label: label, URL: target})
+	}
+	return targets
+}
+
+func defaultScrapeLabel(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return unsafeNameChars.ReplaceAllString(target, "_")
+	}
+	return strings.NewReplacer(":", "_", ".", "_").Replace(u.Host)
+}
+
+func (a *Agent) ScrapeTicker(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	ticker := time.NewTicker(a.pollInterval())
+	for {
+		select {
+		case <-ticker.C:
+			a.scrapeUpdate(ctx, metricsCh)
+		case <-ctx.Done():
+			log.Println("Regular completion of the scrape metrics update")
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+func (a *Agent) scrapeUpdate(ctx context.Context, metricsCh chan<- metrics.Metrics) {
+	prm := metrics.New()
+
+	for _, target := range config.ScrapeTargets {
+		gauges, counters, err := a.scrape(ctx, target)
+		if err != nil {
+			a.handleError(fmt.Errorf("scrape %s failed - %w", target.URL, err))
+			continue
+		}
+
+		for k, v := range gauges {
+			prm.Gauges[k] = v
+		}
+		// Scraped counters are cumulative, the server expects increments.
+		for k, v := range counters {
+			a.putTotalDelta(prm.Counters, k, math.Max(v, 0))
+		}
+	}
+
+	metricsCh <- *prm
+
+	log.Println("Scrape metrics updated")
+}
+
+func (a *Agent) scrape(ctx context.Context, target ScrapeTarget) (map[metrics.Name]metrics.Gauge, map[metrics.Name]float64, error) {
+	resp, err := a.client.R().
+		SetContext(ctx).
+		SetHeader("Accept", "text/plain, application/json").
+		Get(target.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, nil, fmt.Errorf("invalid status code %v", resp.StatusCode())
+	}
+
+	var gauges map[metrics.Name]metrics.Gauge
+	var counters map[metrics.Name]float64
+
+	body := bytes.TrimSpace(resp.Body())
+	if strings.Contains(resp.Header().Get("Content-Type"), "json") || (len(body) > 0 && body[0] == '{') {
+		var m struct {
+			Gauges   map[metrics.Name]metrics.Gauge `json:"gauges"`
+			Counters map[metrics.Name]float64       `json:"counters"`
+		}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, nil, err
+		}
+		gauges, counters = m.Gauges, m.Counters
+	} else {
+		gauges, counters, err = parsePrometheus(body)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	prefixed := make(map[metrics.Name]metrics.Gauge, len(gauges))
+	for k, v := range gauges {
+		prefixed[deviceName(metrics.Name(target.Label), string(k))] = v
+	}
+	prefixedCounters := make(map[metrics.Name]float64, len(counters))
+	for k, v := range counters {
+		prefixedCounters[deviceName(metrics.Name(target.Label), string(k))] = v
+	}
+	return prefixed, prefixedCounters, nil
+}
+
+// parsePrometheus reads the Prometheus text exposition format. Label names
+// and values are appended to the sample name in the order of the names, e.g.
+// http_requests_total{method="GET",code="200"} becomes
+// http_requests_total_code_200_method_GET. Counters and histogram/summary
+// counts are returned as counters, everything else as gauges.
+func parsePrometheus(data []byte) (map[metrics.Name]metrics.Gauge, map[metrics.Name]float64, error) {
+	gauges := make(map[metrics.Name]metrics.Gauge)
+	counters := make(map[metrics.Name]float64)
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %q: %w", line, err)
+		}
+		if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			continue
+		}
+
+		parts := []string{sample.name}
+		for _, l := range sample.labels {
+			parts = append(parts, l.name, l.value)
+		}
+		id := metrics.Name(unsafeNameChars.ReplaceAllString(strings.Join(parts, "_"), "_"))
+
+		if isPrometheusCounter(sample.name, types) {
+			counters[id] = sample.value
+		} else {
+			gauges[id] = metrics.Gauge(sample.value)
+		}
+	}
+	return gauges, counters, scanner.Err()
+}
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	name   string
+	labels []label
+	value  float64
+}
+
+// parseSample parses a sample line: a name, optional labels in braces with
+// quoted and escaped values, the value and an optional timestamp.
+func parseSample(line string) (sample, error) {
+	var s sample
+
+	i := 0
+	for i < len(line) && isNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return s, fmt.Errorf("invalid metric name")
+	}
+	s.name = line[:i]
+
+	if i < len(line) && line[i] == '{' {
+		i++
+		for {
+			i = skipSpaces(line, i)
+			if i < len(line) && line[i] == '}' {
+				i++
+				break
+			}
+
+			start := i
+			for i < len(line) && isNameChar(line[i], i == start) {
+				i++
+			}
+			if i == start {
+				return s, fmt.Errorf("invalid label name")
+			}
+			l := label{name: line[start:i]}
+
+			i = skipSpaces(line, i)
+			if i >= len(line) || line[i] != '=' {
+				return s, fmt.Errorf("label %s: expected =", l.name)
+			}
+			i = skipSpaces(line, i+1)
+			if i >= len(line) || line[i] != '"' {
+				return s, fmt.Errorf("label %s: expected a quoted value", l.name)
+			}
+			i++
+
+			var value strings.Builder
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] != '\\' {
+					value.WriteByte(line[i])
+					continue
+				}
+				i++
+				if i == len(line) {
+					break
+				}
+				switch line[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(line[i])
+				}
+			}
+			if i == len(line) {
+				return s, fmt.Errorf("label %s: unterminated value", l.name)
+			}
+			l.value = value.String()
+			s.labels = append(s.labels, l)
+
+			i = skipSpaces(line, i+1)
+			if i < len(line) && line[i] == ',' {
+				i++
+			} else if i >= len(line) || line[i] != '}' {
+				return s, fmt.Errorf("unterminated labels")
+			}
+		}
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+
+	fields := strings.Fields(line[i:])
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("expected a value and an optional timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, err
+	}
+	s.value = value
+	return s, nil
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func skipSpaces(line string, i int) int {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isPrometheusCounter(name string, types map[string]string) bool {
+	if types[name] == "counter" {
+		return true
+	}
+	for _, suffix := range []string{"_count", "_bucket"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base != name && (types[base] == "histogram" || types[base] == "summary") {
+			return true
+		}
+	}
+	return false
+}
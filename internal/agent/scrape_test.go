@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const prometheusText = `# HELP go_goroutines Number of goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 12
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} 1027
+http_requests_total{method="POST",code="500"} 3
+# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="0.5"} 4
+rpc_duration_seconds_bucket{le="+Inf"} 5
+rpc_duration_seconds_sum 1.75
+rpc_duration_seconds_count 5
+temperature NaN
+`
+
+func TestParsePrometheus(t *testing.T) {
+	gauges, counters, err := parsePrometheus([]byte(prometheusText))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{
+		"go_goroutines":            12,
+		"rpc_duration_seconds_sum": 1.75,
+	}, gauges)
+	assert.Equal(t, map[metrics.Name]float64{
+		"http_requests_total_code_200_method_GET":  1027,
+		"http_requests_total_code_500_method_POST": 3,
+		"rpc_duration_seconds_bucket_le_0.5":       4,
+		"rpc_duration_seconds_bucket_le__Inf":      5,
+		"rpc_duration_seconds_count":               5,
+	}, counters)
+}
+
+func TestParseSample(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    sample
+		wantErr bool
+	}{
+		{
+			name: "No labels",
+			line: "go_goroutines 12",
+			want: sample{name: "go_goroutines", value: 12},
+		},
+		{
+			name: "Timestamp",
+			line: "cpu_seconds_total 3.5 1395066363000",
+			want: sample{name: "cpu_seconds_total", value: 3.5},
+		},
+		{
+			name: "Commas, equal signs and escapes in values",
+			line: `http_requests_total{path="a,b=c", msg="say \"hi\"\\n", code="200",} 7`,
+			want: sample{name: "http_requests_total", value: 7, labels: []label{
+				{"code", "200"}, {"msg", `say "hi"\n`}, {"path", "a,b=c"},
+			}},
+		},
+		{
+			name: "Empty labels",
+			line: "up{} 1",
+			want: sample{name: "up", value: 1},
+		},
+		{
+			name:    "Unterminated value",
+			line:    `up{job="a} 1`,
+			wantErr: true,
+		},
+		{
+			name:    "Unquoted value",
+			line:    `up{job=a} 1`,
+			wantErr: true,
+		},
+		{
+			name:    "Missing value",
+			line:    `up{job="a"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSample(tt.line)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParsePrometheusLabelNames(t *testing.T) {
+	_, counters, err := parsePrometheus([]byte("# TYPE hits_total counter\nhits_total{code=\"200\"} 1\nhits_total{method=\"200\"} 2\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]float64{
+		"hits_total_code_200":   1,
+		"hits_total_method_200": 2,
+	}, counters)
+}
+
+func TestAgent_putTotalDelta(t *testing.T) {
+	a := &Agent{lastTotals: make(map[metrics.Name]total)}
+
+	var sent metrics.Counter
+	for _, v := range []float64{0.4, 0.9, 1.3, 2.2, 2.6, 3.05} {
+		counters := make(map[metrics.Name]metrics.Counter)
+		a.putTotalDelta(counters, "cpu_seconds_total", v)
+		sent += counters["cpu_seconds_total"]
+	}
+	// 3.05 - 0.4 = 2.65 seconds passed, the fraction is still carried.
+	assert.Equal(t, metrics.Counter(2), sent)
+
+	counters := make(map[metrics.Name]metrics.Counter)
+	a.putTotalDelta(counters, "cpu_seconds_total", 3.5)
+	assert.Equal(t, metrics.Counter(1), counters["cpu_seconds_total"])
+}
+
+func TestParseScrapeTargets(t *testing.T) {
+	targets := ParseScrapeTargets("http://localhost:9100/metrics, app=http://localhost:8081/metrics?format=text")
+	assert.Equal(t, []ScrapeTarget{
+		{Label: "localhost_9100", URL: "http://localhost:9100/metrics"},
+		{Label: "app", URL: "http://localhost:8081/metrics?format=text"},
+	}, targets)
+}
+
+func TestAgent_scrapeUpdate(t *testing.T) {
+	requests := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if requests == 1 {
+			w.Write([]byte("# TYPE jobs_total counter\njobs_total 10\nqueue 3\n"))
+			return
+		}
+		w.Write([]byte("# TYPE jobs_total counter\njobs_total 15\nqueue 4\n"))
+	}))
+	defer target.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "127.0.0.1:8080",
+		ScrapeTargets:  []ScrapeTarget{{Label: "app", URL: target.URL}},
+	})
+	require.NoError(t, err)
+
+	metricsCh := make(chan metrics.Metrics, 2)
+	a.scrapeUpdate(context.Background(), metricsCh)
+	a.scrapeUpdate(context.Background(), metricsCh)
+
+	first := <-metricsCh
+	assert.Equal(t, metrics.Gauge(3), first.Gauges["app_queue"])
+	assert.Empty(t, first.Counters)
+
+	second := <-metricsCh
+	assert.Equal(t, metrics.Gauge(4), second.Gauges["app_queue"])
+	assert.Equal(t, metrics.Counter(5), second.Counters["app_jobs_total"])
+}
+
+func TestAgent_scrapeUpdateUnlabelledTargets(t *testing.T) {
+	newTarget := func(totals ...int) *httptest.Server {
+		requests := 0
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total %d\n", totals[requests])
+			requests++
+		}))
+	}
+	first := newTarget(1000, 1010)
+	defer first.Close()
+	second := newTarget(20, 25)
+	defer second.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "127.0.0.1:8080",
+		ScrapeTargets:  ParseScrapeTargets(first.URL + "," + second.URL),
+	})
+	require.NoError(t, err)
+
+	metricsCh := make(chan metrics.Metrics, 2)
+	a.scrapeUpdate(context.Background(), metricsCh)
+	a.scrapeUpdate(context.Background(), metricsCh)
+	<-metricsCh
+	prm := <-metricsCh
+
+	firstName := deviceName(metrics.Name(defaultScrapeLabel(first.URL)), "go_gc_cycles_total")
+	secondName := deviceName(metrics.Name(defaultScrapeLabel(second.URL)), "go_gc_cycles_total")
+	assert.Equal(t, map[metrics.Name]metrics.Counter{firstName: 10, secondName: 5}, prm.Counters)
+}
+
+func TestAgent_scrapeJSON(t *testing.T) {
+	totals := []int{40, 42}
+	requests := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"gauges":{"queue":7.5},"counters":{"jobs":%d}}`, totals[requests])
+		requests++
+	}))
+	defer target.Close()
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        "127.0.0.1:8080",
+		ScrapeTargets:  []ScrapeTarget{{Label: "app", URL: target.URL}},
+	})
+	require.NoError(t, err)
+
+	metricsCh := make(chan metrics.Metrics, 2)
+	a.scrapeUpdate(context.Background(), metricsCh)
+	a.scrapeUpdate(context.Background(), metricsCh)
+	<-metricsCh
+	prm := <-metricsCh
+
+	assert.Equal(t, metrics.Gauge(7.5), prm.Gauges["app_queue"])
+	assert.Equal(t, metrics.Counter(2), prm.Counters["app_jobs"])
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"sync"
+)
+
+type collector func(context.Context, chan<- metrics.Metrics)
+
+// supervisor runs the collectors, each of them can be stopped and started
+// again while the agent is running.
+type supervisor struct {
+	ctx       context.Context
+	metricsCh chan<- metrics.Metrics
+
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[string]*task
+}
+
+type task struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSupervisor(ctx context.Context, metricsCh chan<- metrics.Metrics) *supervisor {
+	return &supervisor{
+		ctx:       ctx,
+		metricsCh: metricsCh,
+		running:   make(map[string]*task),
+	}
+}
+
+// Start runs c unless a collector with that name is already running or the
+// supervisor is shutting down.
+func (s *supervisor) Start(name string, c collector) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.running[name]; ok || s.ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	t := &task{cancel: cancel, done: make(chan struct{})}
+	s.running[name] = t
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(t.done)
+		c(ctx, s.metricsCh)
+	}()
+}
+
+// Stop stops the collector and waits until it returns.
+func (s *supervisor) Stop(name string) {
+	s.mu.Lock()
+	t, ok := s.running[name]
+	delete(s.running, name)
+	s.mu.Unlock()
+
+	if ok {
+		t.cancel()
+		<-t.done
+	}
+}
+
+func (s *supervisor) Running(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.running[name]
+	return ok
+}
+
+// Wait waits for all collectors to return once the supervisor's context is
+// done.
+func (s *supervisor) Wait() {
+	s.wg.Wait()
+}
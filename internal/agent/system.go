@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
+	"math"
+	"strings"
+)
+
+func (a *Agent) swapUpdate(gauges map[metrics.Name]metrics.Gauge) {
+	s, err := mem.SwapMemory()
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting swap metrics via `gopsutil` package - %w", err))
+		return
+	}
+	gauges[metrics.SwapTotal] = metrics.Gauge(s.Total)
+	gauges[metrics.SwapUsed] = metrics.Gauge(s.Used)
+	gauges[metrics.SwapFree] = metrics.Gauge(s.Free)
+}
+
+func (a *Agent) loadUpdate(gauges map[metrics.Name]metrics.Gauge) {
+	l, err := load.Avg()
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting load average via `gopsutil` package - %w", err))
+		return
+	}
+	gauges[metrics.Load1] = metrics.Gauge(l.Load1)
+	gauges[metrics.Load5] = metrics.Gauge(l.Load5)
+	gauges[metrics.Load15] = metrics.Gauge(l.Load15)
+}
+
+func (a *Agent) uptimeUpdate(gauges map[metrics.Name]metrics.Gauge) {
+	u, err := host.Uptime()
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting uptime via `gopsutil` package - %w", err))
+		return
+	}
+	gauges[metrics.Uptime] = metrics.Gauge(u)
+}
+
+func (a *Agent) diskUsageUpdate(gauges map[metrics.Name]metrics.Gauge) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting disk partitions via `gopsutil` package - %w", err))
+		return
+	}
+
+	for _, p := range partitions {
+		u, err := disk.Usage(p.Mountpoint)
+		if err != nil {
+			a.handleError(fmt.Errorf("error getting disk usage of %s via `gopsutil` package - %w", p.Mountpoint, err))
+			continue
+		}
+		mount := mountName(p.Mountpoint)
+		gauges[deviceName(metrics.DiskTotal, mount)] = metrics.Gauge(u.Total)
+		gauges[deviceName(metrics.DiskUsed, mount)] = metrics.Gauge(u.Used)
+		gauges[deviceName(metrics.DiskFree, mount)] = metrics.Gauge(u.Free)
+		gauges[deviceName(metrics.DiskUsedPercent, mount)] = metrics.Gauge(u.UsedPercent)
+	}
+}
+
+func (a *Agent) diskIOUpdate(counters map[metrics.Name]metrics.Counter) {
+	stats, err := disk.IOCounters()
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting disk IO counters via `gopsutil` package - %w", err))
+		return
+	}
+
+	for dev, s := range stats {
+		a.putDelta(counters, deviceName(metrics.DiskReadBytes, dev), s.ReadBytes)
+		a.putDelta(counters, deviceName(metrics.DiskWriteBytes, dev), s.WriteBytes)
+		a.putDelta(counters, deviceName(metrics.DiskReadCount, dev), s.ReadCount)
+		a.putDelta(counters, deviceName(metrics.DiskWriteCount, dev), s.WriteCount)
+	}
+}
+
+func (a *Agent) netIOUpdate(counters map[metrics.Name]metrics.Counter) {
+	stats, err := net.IOCounters(true)
+	if err != nil {
+		a.handleError(fmt.Errorf("error getting network counters via `gopsutil` package - %w", err))
+		return
+	}
+
+	for _, s := range stats {
+		a.putDelta(counters, deviceName(metrics.NetBytesSent, s.Name), s.BytesSent)
+		a.putDelta(counters, deviceName(metrics.NetBytesRecv, s.Name), s.BytesRecv)
+		a.putDelta(counters, deviceName(metrics.NetPacketsSent, s.Name), s.PacketsSent)
+		a.putDelta(counters, deviceName(metrics.NetPacketsRecv, s.Name), s.PacketsRecv)
+		a.putDelta(counters, deviceName(metrics.NetErrIn, s.Name), s.Errin)
+		a.putDelta(counters, deviceName(metrics.NetErrOut, s.Name), s.Errout)
+	}
+}
+
+// putDelta converts a cumulative system counter into the increment since the
+// previous poll, since the server sums every counter value it receives.
+// The first observation only sets the baseline.
+func (a *Agent) putDelta(counters map[metrics.Name]metrics.Counter, name metrics.Name, value uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	prev, ok := a.lastCounters[name]
+	a.lastCounters[name] = value
+	if !ok {
+		return
+	}
+
+	if value < prev {
+		counters[name] = metrics.Counter(value)
+		return
+	}
+	counters[name] = metrics.Counter(value - prev)
+}
+
+// total is the last value of a fractional counter and the fraction of its
+// increments not sent yet.
+type total struct {
+	value, carry float64
+}
+
+// putTotalDelta is putDelta for fractional totals, e.g. seconds. Increments
+// are sent as whole numbers, the remainder is carried into the next one.
+func (a *Agent) putTotalDelta(counters map[metrics.Name]metrics.Counter, name metrics.Name, value float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	prev, ok := a.lastTotals[name]
+	a.lastTotals[name] = total{value: value}
+	if !ok {
+		return
+	}
+
+	delta := value
+	if value >= prev.value {
+		delta = value - prev.value + prev.carry
+	}
+	whole := math.Floor(delta)
+	a.lastTotals[name] = total{value: value, carry: delta - whole}
+	counters[name] = metrics.Counter(whole)
+}
+
+func deviceName(prefix metrics.Name, device string) metrics.Name {
+	return metrics.Name(string(prefix) + "_" + device)
+}
+
+func mountName(mountpoint string) string {
+	name := strings.Trim(mountpoint, "/")
+	if name == "" {
+		return "root"
+	}
+	return strings.ReplaceAll(name, "/", "_")
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAgent_putDelta(t *testing.T) {
+	type want struct {
+		delta metrics.Counter
+		sent  bool
+	}
+	tests := []struct {
+		name  string
+		value uint64
+		want  want
+	}{
+		{
+			name:  "First observation sets baseline",
+			value: 100,
+			want:  want{sent: false},
+		},
+		{
+			name:  "Increment since previous poll",
+			value: 130,
+			want:  want{delta: 30, sent: true},
+		},
+		{
+			name:  "No change",
+			value: 130,
+			want:  want{delta: 0, sent: true},
+		},
+		{
+			name:  "Counter reset",
+			value: 20,
+			want:  want{delta: 20, sent: true},
+		},
+	}
+
+	a := &Agent{lastCounters: make(map[metrics.Name]uint64)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := make(map[metrics.Name]metrics.Counter)
+			a.putDelta(counters, "NetBytesSent_eth0", tt.value)
+
+			delta, ok := counters["NetBytesSent_eth0"]
+			assert.Equal(t, tt.want.sent, ok)
+			assert.Equal(t, tt.want.delta, delta)
+		})
+	}
+}
+
+func TestMountName(t *testing.T) {
+	tests := []struct {
+		mountpoint string
+		want       string
+	}{
+		{mountpoint: "/", want: "root"},
+		{mountpoint: "/home", want: "home"},
+		{mountpoint: "/var/lib/docker/", want: "var_lib_docker"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mountpoint, func(t *testing.T) {
+			assert.Equal(t, tt.want, mountName(tt.mountpoint))
+		})
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	assert.Equal(t, metrics.Name("DiskUsed_root"), deviceName(metrics.DiskUsed, mountName("/")))
+	assert.Equal(t, metrics.Name("NetErrIn_eth0"), deviceName(metrics.NetErrIn, "eth0"))
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"sync"
+	"time"
+)
+
+// telemetry counts what the agent itself did during a report interval, it's
+// reported with the collected metrics so a silent agent can be told from a
+// broken one.
+type telemetry struct {
+	mu       sync.Mutex
+	counters map[metrics.Name]metrics.Counter
+	latency  time.Duration
+	requests int
+}
+
+func newTelemetry() *telemetry {
+	return &telemetry{counters: make(map[metrics.Name]metrics.Counter)}
+}
+
+func (t *telemetry) add(name metrics.Name, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counters[name] += metrics.Counter(n)
+}
+
+// request records a request to a server with its body size before and after
+// compression.
+func (t *telemetry) request(raw, compressed int, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counters[metrics.AgentBytesRaw] += metrics.Counter(raw)
+	t.counters[metrics.AgentBytesSent] += metrics.Counter(compressed)
+	t.latency += latency
+	t.requests++
+}
+
+// retried wraps the sender of a single batch, every call after the first one
+// is counted as a retry.
+func (t *telemetry) retried(sender Sender) Sender {
+	attempts := 0
+	return func(ctx context.Context, prm metrics.Metrics) error {
+		if attempts > 0 {
+			t.add(metrics.AgentRetries, 1)
+		}
+		attempts++
+		return sender(ctx, prm)
+	}
+}
+
+// Snapshot returns the counters since the previous call, the average request
+// latency in seconds and the number of snapshots waiting in the collectors
+// channel.
+func (t *telemetry) Snapshot(queueDepth int) metrics.Metrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prm := metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{metrics.AgentQueueDepth: metrics.Gauge(queueDepth)},
+		Counters: t.counters,
+	}
+	if t.requests > 0 {
+		prm.Gauges[metrics.AgentSendLatency] = metrics.Gauge(t.latency.Seconds() / float64(t.requests))
+	}
+
+	t.counters = make(map[metrics.Name]metrics.Counter)
+	t.latency, t.requests = 0, 0
+	return prm
+}
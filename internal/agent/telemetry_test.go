@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTelemetry_Snapshot(t *testing.T) {
+	tm := newTelemetry()
+	tm.add(metrics.AgentBatchesSent, 2)
+	tm.request(100, 40, time.Second)
+	tm.request(50, 20, 3*time.Second)
+
+	prm := tm.Snapshot(3)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{
+		metrics.AgentQueueDepth:  3,
+		metrics.AgentSendLatency: 2,
+	}, prm.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{
+		metrics.AgentBatchesSent: 2,
+		metrics.AgentBytesRaw:    150,
+		metrics.AgentBytesSent:   60,
+	}, prm.Counters)
+
+	// Counters start over, the latency isn't reported without requests.
+	prm = tm.Snapshot(0)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{metrics.AgentQueueDepth: 0}, prm.Gauges)
+	assert.Empty(t, prm.Counters)
+}
+
+func TestAgent_reportTelemetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "agent-1", r.Header.Get("X-Agent-ID"))
+	}))
+
+	a, err := New(Config{
+		Timeout:        time.Second,
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		Address:        strings.TrimPrefix(server.URL, "http://"),
+		ID:             "agent-1",
+	})
+	require.NoError(t, err)
+
+	prm := metrics.Metrics{Counters: map[metrics.Name]metrics.Counter{metrics.PollCount: 1}}
+	require.NoError(t, a.report(context.Background(), prm))
+
+	server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, a.report(ctx, prm))
+
+	counters := a.telemetry.Snapshot(0).Counters
+	assert.Equal(t, metrics.Counter(1), counters[metrics.AgentBatchesSent])
+	assert.Equal(t, metrics.Counter(1), counters[metrics.AgentBatchesFailed])
+	assert.Equal(t, metrics.Counter(1), counters[metrics.AgentBatchesLost])
+	assert.Equal(t, metrics.Counter(1), counters[metrics.AgentRetries])
+	assert.Greater(t, counters[metrics.AgentBytesRaw], metrics.Counter(0))
+	assert.Greater(t, counters[metrics.AgentBytesSent], metrics.Counter(0))
+}
@@ -2,42 +2,147 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+	"net"
 	"os"
 )
 
+const (
+	StorageMemory   = "memory"
+	StorageFile     = "file"
+	StorageDatabase = "database"
+
+	RuleAccept = "accept"
+	RuleDrop   = "drop"
+)
+
 type Config struct {
-	Address  string `env:"ADDRESS"`
-	Interval int    `env:"STORE_INTERVAL"`
-	Filename string `env:"FILE_STORAGE_PATH"`
-	Restore  bool   `env:"RESTORE"`
-	DSN      string `env:"DATABASE_DSN"`
-	Key      string `env:"KEY"`
+	Address  string `env:"ADDRESS" yaml:"address"`
+	Interval int    `env:"STORE_INTERVAL" yaml:"store_interval"`
+	Filename string `env:"FILE_STORAGE_PATH" yaml:"file_path"`
+	Restore  bool   `env:"RESTORE" yaml:"restore"`
+	DSN      string `env:"DATABASE_DSN" yaml:"dsn"`
+	Key      string `env:"KEY" yaml:"key"`
+
+	AgentConfig string `env:"AGENT_CONFIG" yaml:"agent_config"`
+	StaleAfter  int    `env:"STALE_AFTER" yaml:"stale_after"`
+	Retention   int    `env:"RETENTION" yaml:"retention"`
+	AdminToken  string `env:"ADMIN_TOKEN" yaml:"admin_token"`
+
+	Storage    string   `env:"STORAGE" yaml:"storage"`
+	Keys       []string `yaml:"keys"`
+	Rules      []Rule   `yaml:"rules"`
+	LogLevel   string   `env:"LOG_LEVEL" yaml:"log_level"`
+	ConfigFile string   `env:"CONFIG" yaml:"-"`
+}
+
+// Rule decides whether updates of the metrics matching Match, a name or a
+// prefix ending with "*", are stored. The first matching rule applies,
+// metrics no rule matches are stored.
+type Rule struct {
+	Match  string `yaml:"match"`
+	Action string `yaml:"action"`
 }
 
+var (
+	config   = new(Config)
+	flags    = flag.CommandLine
+	setFlags = make(map[string]string)
+)
+
+// ParseConfig reads the server config. Env vars take precedence over flags,
+// flags over the config file and the file over the defaults.
 func ParseConfig() (Config, error) {
-	config := new(Config)
+	return parse(flag.CommandLine, os.Args[1:])
+}
 
-	flag.StringVar(&config.Address,
+func parse(fs *flag.FlagSet, args []string) (Config, error) {
+	flags = fs
+	fs.StringVar(&config.ConfigFile,
+		"c", "",
+		"YAML or JSON config file, reloaded on SIGHUP")
+	fs.StringVar(&config.Address,
 		"a", "localhost:8080",
 		"Add addres and port in format <address>:<port>")
-	flag.IntVar(&config.Interval,
+	fs.IntVar(&config.Interval,
 		"i", 300,
-		"Saving metrics to file interval")
-	flag.StringVar(&config.Filename,
+		"Interval of saving metrics to file, updates in between are kept in a write-ahead log")
+	fs.StringVar(&config.Filename,
 		"f", "/tmp/metrics-db.json",
 		"File path")
-	flag.BoolVar(&config.Restore,
+	fs.BoolVar(&config.Restore,
 		"r", true,
 		"Restore metrics value from file")
-	flag.StringVar(&config.DSN,
+	fs.StringVar(&config.DSN,
 		"d", "",
 		"Connection string in Postgres format")
-	flag.StringVar(&config.Key,
+	fs.StringVar(&config.Key,
 		"k", "",
 		"Sing key")
+	fs.StringVar(&config.AgentConfig,
+		"ac", "",
+		"JSON file with settings served to agents")
+	fs.IntVar(&config.StaleAfter,
+		"sa", 300,
+		"Seconds without updates after which a metric is shown as stale and an agent as down, 0 disables")
+	fs.IntVar(&config.Retention,
+		"rt", 0,
+		"Seconds without updates after which a metric is removed, 0 keeps metrics forever")
+	fs.StringVar(&config.AdminToken,
+		"at", "",
+		"Token for the admin endpoints deleting and resetting metrics, they are off without it")
+	fs.StringVar(&config.Storage,
+		"s", "",
+		"Storage backend: memory, file or database, chosen by -d and -f by default")
+	fs.StringVar(&config.LogLevel,
+		"l", "info",
+		"Log level: debug, info, warn or error")
+
+	if err := fs.Parse(args); err != nil {
+		return *config, err
+	}
 
-	flag.Parse()
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	return load()
+}
+
+// Reload reads the config file again, flags and env vars keep their
+// precedence.
+func Reload() (Config, error) {
+	return load()
+}
+
+func load() (Config, error) {
+	flags.VisitAll(func(f *flag.Flag) {
+		_ = f.Value.Set(f.DefValue)
+	})
+	config.Keys = nil
+	config.Rules = nil
+
+	filename := setFlags["c"]
+	if v, ok := os.LookupEnv("CONFIG"); ok {
+		filename = v
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return *config, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return *config, fmt.Errorf("could not parse config file %s - %w", filename, err)
+		}
+		config.ConfigFile = filename
+	}
+
+	for name, value := range setFlags {
+		_ = flags.Set(name, value)
+	}
 
 	envConfig := Config{}
 	err := env.Parse(&envConfig)
@@ -63,6 +168,114 @@ func ParseConfig() (Config, error) {
 	if _, ok := os.LookupEnv("KEY"); ok {
 		config.Key = envConfig.Key
 	}
+	if _, ok := os.LookupEnv("AGENT_CONFIG"); ok {
+		config.AgentConfig = envConfig.AgentConfig
+	}
+	if _, ok := os.LookupEnv("STALE_AFTER"); ok {
+		config.StaleAfter = envConfig.StaleAfter
+	}
+	if _, ok := os.LookupEnv("RETENTION"); ok {
+		config.Retention = envConfig.Retention
+	}
+	if _, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		config.AdminToken = envConfig.AdminToken
+	}
+	if _, ok := os.LookupEnv("STORAGE"); ok {
+		config.Storage = envConfig.Storage
+	}
+	if _, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		config.LogLevel = envConfig.LogLevel
+	}
+
+	return *config, config.Validate()
+}
+
+// Validate reports the first invalid setting.
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("address %q: expected <host>:<port> - %w", c.Address, err)
+	}
+
+	switch c.Backend() {
+	case StorageDatabase:
+		if c.DSN == "" {
+			return fmt.Errorf("storage %q needs a dsn", StorageDatabase)
+		}
+	case StorageFile:
+		if c.Filename == "" {
+			return fmt.Errorf("storage %q needs a file path", StorageFile)
+		}
+		if c.Interval <= 0 {
+			return fmt.Errorf("store interval should be a positive number of seconds, got %d", c.Interval)
+		}
+	case StorageMemory:
+	default:
+		return fmt.Errorf("storage %q: expected %s, %s or %s", c.Storage, StorageMemory, StorageFile, StorageDatabase)
+	}
+
+	if c.StaleAfter < 0 {
+		return fmt.Errorf("stale after should not be negative, got %d", c.StaleAfter)
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("retention should not be negative, got %d", c.Retention)
+	}
+
+	for i, key := range c.Keys {
+		if key == "" {
+			return fmt.Errorf("keys[%d] is empty", i)
+		}
+	}
+
+	for i, rule := range c.Rules {
+		if rule.Match == "" {
+			return fmt.Errorf("rules[%d]: match should be a name or a prefix ending with *", i)
+		}
+		switch rule.Action {
+		case RuleAccept, RuleDrop:
+		default:
+			return fmt.Errorf("rules[%d]: action %q: expected %s or %s", i, rule.Action, RuleAccept, RuleDrop)
+		}
+	}
 
-	return *config, nil
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log level %q: %w", c.LogLevel, err)
+	}
+	return nil
+}
+
+// NeedsRestart tells whether next changes settings applied at start only:
+// the address and the storage. Keys, rules, admin token, agent settings,
+// expiry and log level are applied on reload.
+func (c Config) NeedsRestart(next Config) bool {
+	return next.Address != c.Address || next.Backend() != c.Backend() || next.DSN != c.DSN ||
+		next.Filename != c.Filename || next.Interval != c.Interval || next.Restore != c.Restore
+}
+
+// Backend returns the storage backend, by default the database when a DSN is
+// set, otherwise the file when a path is set.
+func (c Config) Backend() string {
+	switch {
+	case c.Storage != "":
+		return c.Storage
+	case c.DSN != "":
+		return StorageDatabase
+	case c.Filename != "":
+		return StorageFile
+	}
+	return StorageMemory
+}
+
+// SignKeys returns the keys for hash checks, the first one signs responses.
+// Listing the old key after the new one lets agents switch over gradually.
+func (c Config) SignKeys() []string {
+	var keys []string
+	if c.Key != "" {
+		keys = append(keys, c.Key)
+	}
+	for _, key := range c.Keys {
+		if key != c.Key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
@@ -0,0 +1,258 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseArgs parses args like ParseConfig does for the command line, on a
+// fresh config.
+func parseArgs(args ...string) (Config, error) {
+	config = new(Config)
+	setFlags = make(map[string]string)
+	return parse(flag.NewFlagSet("server", flag.ContinueOnError), args)
+}
+
+func writeFile(t *testing.T, data string) string {
+	filename := filepath.Join(t.TempDir(), "server.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0666))
+	return filename
+}
+
+const file = `
+address: 0.0.0.0:9090
+storage: file
+file_path: /var/lib/metrics/metrics.json
+store_interval: 60
+key: new
+keys: [new, old]
+retention: 3600
+stale_after: 120
+log_level: warn
+rules:
+  - match: debug_*
+    action: drop
+  - match: debug_keep
+    action: accept
+`
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "Defaults",
+			want: func(t *testing.T, cfg Config) {
+				assert.Equal(t, "localhost:8080", cfg.Address)
+				assert.Equal(t, 300, cfg.Interval)
+				assert.Equal(t, "/tmp/metrics-db.json", cfg.Filename)
+				assert.True(t, cfg.Restore)
+				assert.Equal(t, StorageFile, cfg.Backend())
+				assert.Equal(t, "info", cfg.LogLevel)
+				assert.Empty(t, cfg.Rules)
+			},
+		},
+		{
+			name: "File over defaults",
+			file: file,
+			want: func(t *testing.T, cfg Config) {
+				assert.Equal(t, "0.0.0.0:9090", cfg.Address)
+				assert.Equal(t, 60, cfg.Interval)
+				assert.Equal(t, "/var/lib/metrics/metrics.json", cfg.Filename)
+				assert.Equal(t, []string{"new", "old"}, cfg.SignKeys())
+				assert.Equal(t, 3600, cfg.Retention)
+				assert.Equal(t, 120, cfg.StaleAfter)
+				assert.Equal(t, "warn", cfg.LogLevel)
+				assert.Equal(t, []Rule{{Match: "debug_*", Action: RuleDrop}, {Match: "debug_keep", Action: RuleAccept}}, cfg.Rules)
+			},
+		},
+		{
+			name: "Flags over file",
+			args: []string{"-i", "30", "-l", "debug"},
+			file: file,
+			want: func(t *testing.T, cfg Config) {
+				assert.Equal(t, 30, cfg.Interval)
+				assert.Equal(t, "debug", cfg.LogLevel)
+				assert.Equal(t, "0.0.0.0:9090", cfg.Address)
+			},
+		},
+		{
+			name: "Env over flags",
+			args: []string{"-i", "30", "-d", "postgres://flag"},
+			env:  map[string]string{"STORE_INTERVAL": "15", "DATABASE_DSN": "postgres://env", "STORAGE": "database"},
+			file: file,
+			want: func(t *testing.T, cfg Config) {
+				assert.Equal(t, 15, cfg.Interval)
+				assert.Equal(t, "postgres://env", cfg.DSN)
+				assert.Equal(t, StorageDatabase, cfg.Backend())
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-c", writeFile(t, tt.file)}, args...)
+			}
+
+			cfg, err := parseArgs(args...)
+			require.NoError(t, err)
+			tt.want(t, cfg)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{Address: "localhost:8080", Storage: StorageMemory, LogLevel: "info"}
+	require.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name string
+		set  func(cfg *Config)
+		want string
+	}{
+		{
+			name: "Address without port",
+			set:  func(cfg *Config) { cfg.Address = "localhost" },
+			want: `address "localhost"`,
+		},
+		{
+			name: "Zero store interval",
+			set:  func(cfg *Config) { cfg.Storage, cfg.Filename, cfg.Interval = StorageFile, "metrics.json", 0 },
+			want: "store interval should be a positive number of seconds, got 0",
+		},
+		{
+			name: "File storage without a path",
+			set:  func(cfg *Config) { cfg.Storage, cfg.Interval = StorageFile, 300 },
+			want: `storage "file" needs a file path`,
+		},
+		{
+			name: "Database without a dsn",
+			set:  func(cfg *Config) { cfg.Storage = StorageDatabase },
+			want: `storage "database" needs a dsn`,
+		},
+		{
+			name: "Unknown storage",
+			set:  func(cfg *Config) { cfg.Storage = "redis" },
+			want: `storage "redis": expected memory, file or database`,
+		},
+		{
+			name: "Negative retention",
+			set:  func(cfg *Config) { cfg.Retention = -1 },
+			want: "retention should not be negative, got -1",
+		},
+		{
+			name: "Negative stale after",
+			set:  func(cfg *Config) { cfg.StaleAfter = -1 },
+			want: "stale after should not be negative, got -1",
+		},
+		{
+			name: "Empty key",
+			set:  func(cfg *Config) { cfg.Keys = []string{"new", ""} },
+			want: "keys[1] is empty",
+		},
+		{
+			name: "Rule without a match",
+			set:  func(cfg *Config) { cfg.Rules = []Rule{{Action: RuleDrop}} },
+			want: "rules[0]: match should be a name or a prefix ending with *",
+		},
+		{
+			name: "Unknown rule action",
+			set:  func(cfg *Config) { cfg.Rules = []Rule{{Match: "debug_*", Action: "keep"}} },
+			want: `rules[0]: action "keep": expected accept or drop`,
+		},
+		{
+			name: "Unknown log level",
+			set:  func(cfg *Config) { cfg.LogLevel = "verbose" },
+			want: `log level "verbose"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.set(&cfg)
+			assert.ErrorContains(t, cfg.Validate(), tt.want)
+		})
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	_, err := parseArgs("-i", "0")
+	assert.ErrorContains(t, err, "store interval")
+
+	_, err = parseArgs("-c", writeFile(t, "rules: drop\n"))
+	assert.ErrorContains(t, err, "could not parse config file")
+}
+
+func TestReload(t *testing.T) {
+	filename := writeFile(t, file)
+	cfg, err := parseArgs("-c", filename, "-l", "error")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filename, []byte(`
+address: 0.0.0.0:9090
+storage: file
+file_path: /var/lib/metrics/metrics.json
+store_interval: 60
+key: newer
+retention: 600
+log_level: debug
+rules:
+  - match: tmp_*
+    action: drop
+`), 0666))
+	next, err := Reload()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"newer"}, next.SignKeys())
+	assert.Equal(t, []Rule{{Match: "tmp_*", Action: RuleDrop}}, next.Rules)
+	assert.Equal(t, 600, next.Retention)
+	assert.Equal(t, 300, next.StaleAfter, "removed from the file")
+	assert.Equal(t, "error", next.LogLevel, "the flag keeps its precedence")
+	assert.False(t, cfg.NeedsRestart(next), "keys, rules, expiry and log level are reloaded")
+
+	require.NoError(t, os.WriteFile(filename, []byte("address: 0.0.0.0:9091\nstore_interval: 60\n"), 0666))
+	next, err = Reload()
+	require.NoError(t, err)
+	assert.True(t, cfg.NeedsRestart(next))
+}
+
+func TestConfig_NeedsRestart(t *testing.T) {
+	cfg := Config{Address: "localhost:8080", Filename: "metrics.json", Interval: 300, Restore: true, LogLevel: "info"}
+
+	tests := []struct {
+		name string
+		set  func(cfg *Config)
+		want bool
+	}{
+		{name: "Keys", set: func(cfg *Config) { cfg.Key, cfg.Keys = "new", []string{"old"} }},
+		{name: "Rules", set: func(cfg *Config) { cfg.Rules = []Rule{{Match: "debug_*", Action: RuleDrop}} }},
+		{name: "Log level", set: func(cfg *Config) { cfg.LogLevel = "debug" }},
+		{name: "Expiry", set: func(cfg *Config) { cfg.StaleAfter, cfg.Retention = 60, 600 }},
+		{name: "Admin token", set: func(cfg *Config) { cfg.AdminToken = "admin" }},
+		{name: "Agent settings", set: func(cfg *Config) { cfg.AgentConfig = "agents.json" }},
+		{name: "Address", set: func(cfg *Config) { cfg.Address = "localhost:9090" }, want: true},
+		{name: "Storage", set: func(cfg *Config) { cfg.Storage = StorageMemory }, want: true},
+		{name: "DSN", set: func(cfg *Config) { cfg.DSN = "postgres://localhost" }, want: true},
+		{name: "File path", set: func(cfg *Config) { cfg.Filename = "other.json" }, want: true},
+		{name: "Store interval", set: func(cfg *Config) { cfg.Interval = 60 }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := cfg
+			tt.set(&next)
+			assert.Equal(t, tt.want, cfg.NeedsRestart(next))
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/server/telemetry"
+	"github.com/Osselnet/metrics-collector/internal/storage"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -17,12 +19,17 @@ const (
 	initTimeOut  = 2 * time.Second
 	queryTimeOut = 1 * time.Second
 
-	queryInsertGauge   = `INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)`
-	queryInsertCounter = `INSERT INTO metrics (id, type, delta) VALUES ($1, 'counter', $2)`
-	queryUpdateGauge   = `UPDATE metrics SET value = $2 WHERE id = $1`
-	queryUpdateCounter = `UPDATE metrics SET delta = $2 WHERE id = $1`
+	queryInsertGauge   = `INSERT INTO metrics (id, type, value, updated_at) VALUES ($1, 'gauge', $2, now()) ON CONFLICT (id) DO NOTHING`
+	queryInsertCounter = `INSERT INTO metrics (id, type, delta, updated_at) VALUES ($1, 'counter', $2, now()) ON CONFLICT (id) DO NOTHING`
+	queryUpdateGauge   = `UPDATE metrics SET value = $2, updated_at = now() WHERE id = $1 AND type = 'gauge'`
+	queryUpdateCounter = `UPDATE metrics SET delta = COALESCE(delta, 0) + $2, updated_at = now() WHERE id = $1 AND type = 'counter'`
 	queryGet           = `SELECT id, type, value, delta FROM metrics WHERE id=$1`
 	queryGetMetrics    = `SELECT id, type, value, delta FROM metrics`
+	queryGetUpdated    = `SELECT id, updated_at FROM metrics`
+	queryGetUpdatedAt  = `SELECT updated_at FROM metrics WHERE id = $1`
+	queryExpire        = `DELETE FROM metrics WHERE updated_at < $1`
+	queryDelete        = `DELETE FROM metrics WHERE id = $1 AND type = $2`
+	queryResetCounter  = `UPDATE metrics SET delta = 0, updated_at = now() WHERE id = $1 AND type = 'counter'`
 )
 
 type DateBaseStorage interface {
@@ -30,6 +37,11 @@ type DateBaseStorage interface {
 	Get(context.Context, string) (interface{}, error)
 	PutMetrics(context.Context, metrics.Metrics) error
 	GetMetrics(context.Context) (metrics.Metrics, error)
+	Updated(context.Context) (map[metrics.Name]time.Time, error)
+	UpdatedAt(ctx context.Context, key string) (time.Time, error)
+	Expire(context.Context, time.Time) (int, error)
+	Delete(ctx context.Context, mtype, key string) error
+	ResetCounter(ctx context.Context, key string) error
 
 	Ping(parentCtx context.Context) error
 	Shutdown() error
@@ -74,70 +86,38 @@ func (s *MemStorageDB) Put(parentCtx context.Context, id string, val interface{}
 
 func (s *MemStorageDB) putGauge(ctx context.Context, id string, val metrics.Gauge) error {
 	fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
-	result, err := fn(ctx, queryUpdateGauge, id, val)
-
-	if err != nil {
-		return err
-	}
-
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if rows == 0 {
-		fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
-		_, err = fn(ctx, queryInsertGauge, id, val)
-
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return upsert(ctx, fn, queryUpdateGauge, queryInsertGauge, id, val)
 }
 
 func (s *MemStorageDB) putCounter(ctx context.Context, id string, val metrics.Counter) error {
 	fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
-	result, err := fn(ctx, queryGet, id)
-
-	if err != nil {
-		return err
-	}
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if rows == 0 {
-		fn1 := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
-		_, err = fn1(ctx, queryInsertCounter, id, val)
+	return upsert(ctx, fn, queryUpdateCounter, queryInsertCounter, id, val)
+}
 
+// upsert updates the metric of the value type or inserts it. The update is
+// tried again when the insert lost a race, if it still changes nothing the
+// id belongs to a metric of the other type.
+func upsert(ctx context.Context, exec ExecContext, update, insert, id string, val interface{}) error {
+	for _, query := range []string{update, insert, update} {
+		result, err := exec(ctx, query, id, val)
 		if err != nil {
 			return err
 		}
-		return nil
-	}
-
-	mdb := metricsDB{}
-	fn3 := RetryQueryRowContext(s.db.QueryRowContext, 3, 1*time.Second)
-	row := fn3(ctx, queryGet, id)
-	err = row.Scan(&mdb.ID, &mdb.MType, &mdb.Value, &mdb.Delta)
-
-	if err != nil {
-		return err
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows > 0 {
+			return nil
+		}
 	}
 
-	if !mdb.Delta.Valid {
-		mdb.Delta.Int64 = 0
+	mtype := storage.TypeOf(val)
+	stored := metrics.TypeCounter
+	if mtype == metrics.TypeCounter {
+		stored = metrics.TypeGauge
 	}
-
-	count := val + metrics.Counter(mdb.Delta.Int64)
-
-	fn2 := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
-	_, err = fn2(ctx, queryUpdateCounter, id, count)
-
-	if err != nil {
-		return err
-	}
-	return nil
+	return storage.TypeConflict(id, stored, mtype)
 }
 
 func (s *MemStorageDB) Get(parentCtx context.Context, id string) (interface{}, error) {
@@ -145,6 +125,9 @@ func (s *MemStorageDB) Get(parentCtx context.Context, id string) (interface{}, e
 	defer cancel()
 
 	m, err := s.getID(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, storage.NotFound(id)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -174,8 +157,10 @@ func (s *MemStorageDB) getID(ctx context.Context, id string) (metricsDB, error)
 	return m, err
 }
 
+// PutMetrics puts a batch like Put does for each value in a single
+// transaction.
 func (s *MemStorageDB) PutMetrics(ctx context.Context, m metrics.Metrics) error {
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -206,56 +191,17 @@ func (s *MemStorageDB) PutMetrics(ctx context.Context, m metrics.Metrics) error
 func (s *MemStorageDB) putGauges(ctx context.Context, tx *sql.Tx, m metrics.Metrics) error {
 	for id, value := range m.Gauges {
 		fn := RetryExecContext(tx.ExecContext, 3, 1*time.Second)
-		result, err := fn(ctx, queryUpdateGauge, id, value)
-
-		if err != nil {
-			return err
-		}
-		count, err := result.RowsAffected()
-		if err != nil {
+		if err := upsert(ctx, fn, queryUpdateGauge, queryInsertGauge, string(id), value); err != nil {
 			return err
 		}
-		if count == 0 {
-			fn := RetryExecContext(tx.ExecContext, 3, 1*time.Second)
-			_, err := fn(ctx, queryInsertGauge, id, value)
-
-			if err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
 
 func (s *MemStorageDB) putCounters(ctx context.Context, tx *sql.Tx, m metrics.Metrics) error {
 	for id, delta := range m.Counters {
-		mdb := metricsDB{}
-		fn := RetryQueryContext(s.db.QueryContext, 3, 1*time.Second)
-		rows, err := fn(ctx, queryGet, id)
-
-		if err != nil || rows.Err() != nil {
-			return err
-		}
-		err = rows.Scan(&mdb.ID, &mdb.MType, &mdb.Value, &mdb.Delta)
-		if err == sql.ErrNoRows {
-			fn := RetryExecContext(tx.ExecContext, 3, 1*time.Second)
-			_, err := fn(ctx, queryInsertCounter, id, delta)
-
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		if err != nil {
-			return err
-		}
-		v := metrics.Counter(0)
-		if mdb.Delta.Valid {
-			v = metrics.Counter(mdb.Delta.Int64)
-		}
-		hm := delta + v
-		fn1 := RetryExecContext(tx.ExecContext, 3, 1*time.Second)
-		if _, err := fn1(ctx, queryUpdateCounter, id, hm); err != nil {
+		fn := RetryExecContext(tx.ExecContext, 3, 1*time.Second)
+		if err := upsert(ctx, fn, queryUpdateCounter, queryInsertCounter, string(id), delta); err != nil {
 			return err
 		}
 	}
@@ -309,6 +255,95 @@ func (s *MemStorageDB) queryMetrics(parentCtx context.Context) (*sql.Rows, error
 	return fn(ctx, queryGetMetrics)
 }
 
+func (s *MemStorageDB) Updated(parentCtx context.Context) (map[metrics.Name]time.Time, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, queryTimeOut)
+	defer cancel()
+
+	fn := RetryQueryContext(s.db.QueryContext, 3, 1*time.Second)
+	rows, err := fn(ctx, queryGetUpdated)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	updated := make(map[metrics.Name]time.Time)
+	for rows.Next() {
+		var id string
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+		updated[metrics.Name(id)] = t
+	}
+	return updated, rows.Err()
+}
+
+// UpdatedAt returns the time the metric was last written.
+func (s *MemStorageDB) UpdatedAt(parentCtx context.Context, id string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, queryTimeOut)
+	defer cancel()
+
+	var t time.Time
+	fn := RetryQueryRowContext(s.db.QueryRowContext, 3, 1*time.Second)
+	err := fn(ctx, queryGetUpdatedAt, id).Scan(&t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, storage.NotFound(id)
+	}
+	return t, err
+}
+
+// Expire removes the metrics not written since before.
+func (s *MemStorageDB) Expire(parentCtx context.Context, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, queryTimeOut)
+	defer cancel()
+
+	fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
+	result, err := fn(ctx, queryExpire, before)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// Delete removes the metric of the type, storage.ErrNotFound means there's
+// no such metric.
+func (s *MemStorageDB) Delete(parentCtx context.Context, mtype, key string) error {
+	ctx, cancel := context.WithTimeout(parentCtx, queryTimeOut)
+	defer cancel()
+
+	fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
+	result, err := fn(ctx, queryDelete, key, mtype)
+	if err != nil {
+		return err
+	}
+	return notFound(result)
+}
+
+func (s *MemStorageDB) ResetCounter(parentCtx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(parentCtx, queryTimeOut)
+	defer cancel()
+
+	fn := RetryExecContext(s.db.ExecContext, 3, 1*time.Second)
+	result, err := fn(ctx, queryResetCounter, key)
+	if err != nil {
+		return err
+	}
+	return notFound(result)
+}
+
+func notFound(result sql.Result) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
 func (s *MemStorageDB) Ping(parentCtx context.Context) error {
 	ctx, cancel := context.WithTimeout(parentCtx, 1*time.Second)
 	defer cancel()
@@ -332,13 +367,16 @@ func (s *MemStorageDB) Shutdown() error {
 func Retry(sender Sender, retries int, delay time.Duration) Sender {
 	return func(ctx context.Context) error {
 		for r := 0; ; r++ {
+			start := time.Now()
 			err := sender(ctx)
+			telemetry.Query(time.Since(start))
 			var pgErr *pgconn.PgError
 			if !(errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code)) || r >= retries {
 				return err
 			}
 
 			log.Printf("Function call failed, retrying in %v", delay)
+			telemetry.Retry()
 
 			delay = delay + time.Second*2
 
@@ -354,13 +392,16 @@ func Retry(sender Sender, retries int, delay time.Duration) Sender {
 func RetryQueryContext(sender QueryContext, retries int, delay time.Duration) QueryContext {
 	return func(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
 		for r := 0; ; r++ {
+			start := time.Now()
 			rows, err := sender(ctx, query, args...)
+			telemetry.Query(time.Since(start))
 			var pgErr *pgconn.PgError
 			if !(errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code)) || r >= retries {
 				return rows, err
 			}
 
 			log.Printf("Function call failed, retrying in %v", delay)
+			telemetry.Retry()
 
 			delay = delay + time.Second*2
 
@@ -376,13 +417,16 @@ func RetryQueryContext(sender QueryContext, retries int, delay time.Duration) Qu
 func RetryQueryRowContext(sender QueryRowContext, retries int, delay time.Duration) QueryRowContext {
 	return func(ctx context.Context, query string, args ...any) *sql.Row {
 		for r := 0; ; r++ {
+			start := time.Now()
 			row := sender(ctx, query, args...)
+			telemetry.Query(time.Since(start))
 			var pgErr *pgconn.PgError
 			if !(errors.As(row.Err(), &pgErr) && pgerrcode.IsConnectionException(pgErr.Code)) || r >= retries {
 				return row
 			}
 
 			log.Printf("Function call failed, retrying in %v", delay)
+			telemetry.Retry()
 
 			delay = delay + time.Second*2
 
@@ -398,7 +442,9 @@ func RetryQueryRowContext(sender QueryRowContext, retries int, delay time.Durati
 func RetryExecContext(sender ExecContext, retries int, delay time.Duration) ExecContext {
 	return func(ctx context.Context, query string, args ...any) (sql.Result, error) {
 		for r := 0; ; r++ {
+			start := time.Now()
 			result, err := sender(ctx, query, args...)
+			telemetry.Query(time.Since(start))
 
 			var pgErr *pgconn.PgError
 			if !(errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code)) || r >= retries {
@@ -406,6 +452,7 @@ func RetryExecContext(sender ExecContext, retries int, delay time.Duration) Exec
 			}
 
 			log.Printf("Function call failed, retrying in %v", delay)
+			telemetry.Retry()
 
 			delay = delay + time.Second*2
 
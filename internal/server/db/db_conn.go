@@ -15,9 +15,11 @@ const (
 			type text NOT NULL,
 			value double precision,
 			delta bigint,
+			updated_at timestamptz NOT NULL DEFAULT now(),
 			PRIMARY KEY (id)
 		);
 	`
+	queryAddUpdatedAt = `ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now()`
 )
 
 func New(dsn string) DateBaseStorage {
@@ -51,6 +53,11 @@ func (s *MemStorageDB) init(dsn string) error {
 		}
 
 		log.Println("table `metrics` created")
+		return nil
 	}
-	return nil
+
+	// Tables created before metrics expiry have no timestamps.
+	fn = RetryExecContext(db.ExecContext, 3, 1*time.Second)
+	_, err = fn(ctx, queryAddUpdatedAt)
+	return err
 }
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/internal/storage/storagetest"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestMemStorageDB(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repositories {
+		db, err := sql.Open("standin", t.Name())
+		require.NoError(t, err)
+		s := &MemStorageDB{db: db}
+		t.Cleanup(func() { s.Shutdown() })
+		return s
+	})
+}
+
+// TEST_DATABASE_DSN points to a Postgres database whose metrics table is
+// cleared by the tests.
+func TestMemStorageDB_Postgres(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	s := &MemStorageDB{}
+	require.NoError(t, s.init(dsn))
+	t.Cleanup(func() { s.Shutdown() })
+
+	storagetest.Run(t, func(t *testing.T) storage.Repositories {
+		_, err := s.db.ExecContext(context.Background(), `DELETE FROM metrics`)
+		require.NoError(t, err)
+		return s
+	})
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// standin is a database/sql driver answering the queries of MemStorageDB the
+// way Postgres does, so the storage runs without a server. Each DSN is a
+// separate database, a transaction locks the whole database.
+type standin struct {
+	mu  sync.Mutex
+	dbs map[string]*standinDB
+}
+
+type standinDB struct {
+	mu   sync.Mutex
+	rows map[string]standinRow
+}
+
+type standinRow struct {
+	mtype   string
+	value   interface{}
+	delta   interface{}
+	updated time.Time
+}
+
+func init() {
+	sql.Register("standin", &standin{dbs: make(map[string]*standinDB)})
+}
+
+func (d *standin) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	db, ok := d.dbs[dsn]
+	if !ok {
+		db = &standinDB{rows: make(map[string]standinRow)}
+		d.dbs[dsn] = db
+	}
+	return &standinConn{db: db}, nil
+}
+
+type standinConn struct {
+	db *standinDB
+	tx *standinTx
+}
+
+type standinTx struct {
+	conn     *standinConn
+	snapshot map[string]standinRow
+}
+
+func (c *standinConn) Prepare(string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("standin: prepared statements are not supported")
+}
+
+func (c *standinConn) Close() error {
+	return nil
+}
+
+func (c *standinConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *standinConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.db.mu.Lock()
+	snapshot := make(map[string]standinRow, len(c.db.rows))
+	for id, row := range c.db.rows {
+		snapshot[id] = row
+	}
+	c.tx = &standinTx{conn: c, snapshot: snapshot}
+	return c.tx, nil
+}
+
+func (tx *standinTx) Commit() error {
+	tx.conn.tx = nil
+	tx.conn.db.mu.Unlock()
+	return nil
+}
+
+func (tx *standinTx) Rollback() error {
+	tx.conn.db.rows = tx.snapshot
+	tx.conn.tx = nil
+	tx.conn.db.mu.Unlock()
+	return nil
+}
+
+func (c *standinConn) lock() func() {
+	if c.tx != nil {
+		return func() {}
+	}
+	c.db.mu.Lock()
+	return c.db.mu.Unlock
+}
+
+func (c *standinConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer c.lock()()
+	rows := c.db.rows
+
+	affected := 0
+	switch query {
+	case queryTableValidation, queryAddUpdatedAt:
+	case queryInsertGauge, queryInsertCounter:
+		id := args[0].Value.(string)
+		if _, ok := rows[id]; ok {
+			break
+		}
+		if query == queryInsertGauge {
+			rows[id] = standinRow{mtype: "gauge", value: args[1].Value, updated: time.Now()}
+		} else {
+			rows[id] = standinRow{mtype: "counter", delta: args[1].Value, updated: time.Now()}
+		}
+		affected = 1
+	case queryUpdateGauge:
+		id := args[0].Value.(string)
+		row, ok := rows[id]
+		if !ok || row.mtype != "gauge" {
+			break
+		}
+		row.value, row.updated = args[1].Value, time.Now()
+		rows[id] = row
+		affected = 1
+	case queryUpdateCounter:
+		id := args[0].Value.(string)
+		row, ok := rows[id]
+		if !ok || row.mtype != "counter" {
+			break
+		}
+		delta, _ := row.delta.(int64)
+		row.delta, row.updated = delta+args[1].Value.(int64), time.Now()
+		rows[id] = row
+		affected = 1
+	case queryResetCounter:
+		id := args[0].Value.(string)
+		row, ok := rows[id]
+		if !ok || row.mtype != "counter" {
+			break
+		}
+		row.delta, row.updated = int64(0), time.Now()
+		rows[id] = row
+		affected = 1
+	case queryDelete:
+		id := args[0].Value.(string)
+		if row, ok := rows[id]; ok && row.mtype == args[1].Value.(string) {
+			delete(rows, id)
+			affected = 1
+		}
+	case queryExpire:
+		before := args[0].Value.(time.Time)
+		for id, row := range rows {
+			if row.updated.Before(before) {
+				delete(rows, id)
+				affected++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("standin: unsupported query %q", query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (c *standinConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer c.lock()()
+
+	result := &standinRows{}
+	switch query {
+	case queryGet, queryGetMetrics:
+		result.columns = []string{"id", "type", "value", "delta"}
+		for id, row := range c.db.rows {
+			if query == queryGet && id != args[0].Value.(string) {
+				continue
+			}
+			result.values = append(result.values, []driver.Value{id, row.mtype, row.value, row.delta})
+		}
+	case queryGetUpdated:
+		result.columns = []string{"id", "updated_at"}
+		for id, row := range c.db.rows {
+			result.values = append(result.values, []driver.Value{id, row.updated})
+		}
+	case queryGetUpdatedAt:
+		result.columns = []string{"updated_at"}
+		if row, ok := c.db.rows[args[0].Value.(string)]; ok {
+			result.values = append(result.values, []driver.Value{row.updated})
+		}
+	default:
+		return nil, fmt.Errorf("standin: unsupported query %q", query)
+	}
+	return result, nil
+}
+
+type standinRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *standinRows) Columns() []string {
+	return r.columns
+}
+
+func (r *standinRows) Close() error {
+	return nil
+}
+
+func (r *standinRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WithAdminToken sets the bearer token of the admin endpoints, they are
+// disabled while it's empty.
+func (h *Handler) WithAdminToken(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.adminToken = token
+}
+
+func (h *Handler) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		token := h.adminToken
+		h.mu.RUnlock()
+
+		if token == "" {
+			http.Error(w, "admin API is disabled", http.StatusForbidden)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Delete removes a single metric.
+func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	name := chi.URLParam(r, "name")
+
+	if reserved(w, name) {
+		return
+	}
+	if metricType != metrics.TypeGauge && metricType != metrics.TypeCounter {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+
+	err := h.Storage.Delete(r.Context(), metricType, name)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ResetCounter sets a counter to zero.
+func (h *Handler) ResetCounter(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if reserved(w, name) {
+		return
+	}
+
+	err := h.Storage.ResetCounter(r.Context(), name)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteMatching removes the metrics whose names match the glob in the
+// pattern query parameter, optionally of a single type, and responds with
+// the removed names.
+func (h *Handler) DeleteMatching(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	metricType := r.URL.Query().Get("type")
+
+	if pattern == "" {
+		http.Error(w, "pattern should not be empty", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, fmt.Sprintf("pattern %q - %v", pattern, err), http.StatusBadRequest)
+		return
+	}
+
+	mcs, err := h.Storage.GetMetrics(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type match struct{ mtype, name string }
+	var matches []match
+	if metricType == "" || metricType == metrics.TypeGauge {
+		for k := range mcs.Gauges {
+			matches = append(matches, match{metrics.TypeGauge, string(k)})
+		}
+	}
+	if metricType == "" || metricType == metrics.TypeCounter {
+		for k := range mcs.Counters {
+			matches = append(matches, match{metrics.TypeCounter, string(k)})
+		}
+	}
+
+	deleted := make([]string, 0)
+	for _, m := range matches {
+		if ok, _ := path.Match(pattern, m.name); !ok {
+			continue
+		}
+		err := h.Storage.Delete(r.Context(), m.mtype, m.name)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleted = append(deleted, m.name)
+	}
+	sort.Strings(deleted)
+
+	writeJSON(w, map[string][]string{"deleted": deleted})
+}
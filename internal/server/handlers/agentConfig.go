@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"net/http"
+)
+
+// WithAgentConfig sets the settings served on GET /agent-config. It can be
+// called again to replace them while the server is running.
+func (h *Handler) WithAgentConfig(f *agentconfig.File) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.agentConfig = f
+}
+
+// AgentConfig returns the settings for the agent given by the id and group
+// query parameters.
+func (h *Handler) AgentConfig(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	f := h.agentConfig
+	h.mu.RUnlock()
+
+	if f == nil {
+		http.Error(w, "agent config is not set", http.StatusNotFound)
+		return
+	}
+
+	settings := f.Resolve(r.URL.Query().Get("id"), r.URL.Query().Get("group"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/Osselnet/metrics-collector/internal/server/telemetry"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"log"
+	"net/http"
+	"time"
+)
+
+// agentHeader carries the id of the agent sending the request, every such
+// request counts as a heartbeat.
+const agentHeader = "X-Agent-ID"
+
+// The header isn't authenticated, so the agents tracked are capped: known
+// agents are still refreshed, new ones are ignored until Expire forgets
+// some. Longer ids are ignored too, they end up in metric names.
+const (
+	maxAgents     = 1024
+	maxAgentIDLen = 128
+)
+
+// staleHeader marks a value not updated for longer than staleAfter.
+const staleHeader = "X-Metric-Stale"
+
+const (
+	agentLastSeen = telemetry.Namespace + "agent_last_seen_"
+	agentUp       = telemetry.Namespace + "agent_up_"
+)
+
+// WithExpiry sets how long a metric may go without updates before it's
+// shown as stale, and its agent as down, and before it's removed. Zero
+// disables either.
+func (h *Handler) WithExpiry(staleAfter, retention time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.staleAfter, h.retention = staleAfter, retention
+}
+
+// Expire removes the metrics and forgets the agents not updated within the
+// retention.
+func (h *Handler) Expire(ctx context.Context) error {
+	h.mu.Lock()
+	retention := h.retention
+	if retention > 0 {
+		for id, t := range h.agents {
+			if time.Since(t) > retention {
+				delete(h.agents, id)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if retention == 0 {
+		return nil
+	}
+
+	removed, err := h.Storage.Expire(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d metrics not updated for %v", removed, retention)
+	}
+	return nil
+}
+
+func (h *Handler) stale(updated time.Time) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.staleAfter > 0 && !updated.IsZero() && time.Since(updated) > h.staleAfter
+}
+
+// updated returns when the stored metric was last written, zero for server
+// metrics or when it's unknown.
+func (h *Handler) updated(ctx context.Context, name string) time.Time {
+	if telemetry.Reserved(name) {
+		return time.Time{}
+	}
+	updated, err := h.Storage.UpdatedAt(ctx, name)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Println("Could not read metric timestamp", err)
+	}
+	return updated
+}
+
+func (h *Handler) heartbeat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(agentHeader); id != "" && len(id) <= maxAgentIDLen {
+			h.mu.Lock()
+			if _, ok := h.agents[id]; ok || len(h.agents) < maxAgents {
+				h.agents[id] = time.Now()
+			}
+			h.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// addAgentMetrics adds the last heartbeat of every agent in unix seconds and,
+// when staleness is on, whether the agent is up.
+func (h *Handler) addAgentMetrics(mcs metrics.Metrics) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for id, t := range h.agents {
+		mcs.Gauges[metrics.Name(agentLastSeen+id)] = metrics.Gauge(t.Unix())
+		if h.staleAfter > 0 {
+			up := metrics.Gauge(0)
+			if time.Since(t) <= h.staleAfter {
+				up = 1
+			}
+			mcs.Gauges[metrics.Name(agentUp+id)] = up
+		}
+	}
+}
@@ -2,28 +2,47 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/Osselnet/metrics-collector/internal/server/db"
 	"github.com/Osselnet/metrics-collector/internal/server/middleware/gzip"
 	"github.com/Osselnet/metrics-collector/internal/server/middleware/logger"
 	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"log"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 )
 
 type Handler struct {
 	router    chi.Router
 	Storage   storage.Repositories
 	dbStorage db.DateBaseStorage
-	key       string
+
+	mu          sync.RWMutex
+	keys        []string
+	agentConfig *agentconfig.File
+	staleAfter  time.Duration
+	retention   time.Duration
+	agents      map[string]time.Time
+	adminToken  string
+	meta        *metrics.Registry
+	rules       []Rule
 }
 
 func New(router chi.Router, dbStorage db.DateBaseStorage, filename string, restore bool, key string) *Handler {
 	h := &Handler{
 		router:    router,
 		dbStorage: dbStorage,
-		key:       key,
+		agents:    make(map[string]time.Time),
+		meta:      metrics.NewRegistry(),
+	}
+	if key != "" {
+		h.keys = []string{key}
 	}
 
 	if h.dbStorage != nil {
@@ -53,16 +72,50 @@ func New(router chi.Router, dbStorage db.DateBaseStorage, filename string, resto
 	h.router.Use(middleware.Recoverer)
 	h.router.Use(logger.LogHandler)
 	h.router.Use(gzip.GzipHandle)
+	h.router.Use(h.heartbeat)
 
 	h.setRoutes()
 
 	return h
 }
 
-func (h *Handler) WithStorage(st *storage.MemStorage) {
+func (h *Handler) WithStorage(st storage.Repositories) {
 	h.Storage = st
 }
 
+// WithKeys replaces the hash keys. The first one signs responses, requests
+// signed with any of them are accepted.
+func (h *Handler) WithKeys(keys ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys = keys
+}
+
+func (h *Handler) signKey() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.keys) == 0 {
+		return ""
+	}
+	return h.keys[0]
+}
+
+// validHash tells whether hash was made with one of the keys, it's always
+// true when no key is set.
+func (h *Handler) validHash(hash string, sign func(key string) string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.keys) == 0 {
+		return true
+	}
+	for _, key := range h.keys {
+		if sign(key) == hash {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) setRoutes() {
 	h.router.Get("/", h.List)
 
@@ -78,6 +131,28 @@ func (h *Handler) setRoutes() {
 	h.router.Post("/update/", h.JSONUpdate)
 
 	h.router.Get("/ping", h.Ping)
+
+	h.router.Get("/agent-config", h.AgentConfig)
+
+	h.router.Delete("/value/{type}/{name}", h.admin(h.Delete))
+	h.router.Delete("/value/", h.admin(h.DeleteMatching))
+	h.router.Post("/value/counter/{name}/reset", h.admin(h.ResetCounter))
+
+	h.router.Get("/meta/", h.MetaList)
+	h.router.Get("/meta/{name}", h.Meta)
+	h.router.Put("/meta/{name}", h.admin(h.SetMeta))
+}
+
+// storageError maps storage errors to response statuses.
+func storageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrTypeConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (h *Handler) GetRouter() chi.Router {
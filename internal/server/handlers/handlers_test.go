@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/agentconfig"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
@@ -9,7 +13,9 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandler_Post(t *testing.T) {
@@ -42,6 +48,20 @@ func TestHandler_Post(t *testing.T) {
 				statusCode: http.StatusNotImplemented,
 			},
 		},
+		{
+			name:    "Post counter as gauge",
+			request: "/update/gauge/PollCount/1",
+			want: want{
+				statusCode: http.StatusConflict,
+			},
+		},
+		{
+			name:    "Post reserved name",
+			request: "/update/counter/server_db_queries/1",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
 		{
 			name:    "Post not found",
 			request: "/update/",
@@ -67,6 +87,14 @@ func TestHandler_Post(t *testing.T) {
 	}
 }
 
+func memStorage(m metrics.Metrics) *storage.MemStorage {
+	st := storage.New()
+	if err := st.PutMetrics(context.Background(), m); err != nil {
+		panic(err)
+	}
+	return st
+}
+
 func testRequest(t *testing.T, ts *httptest.Server, method, path string) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, nil)
 	require.NoError(t, err)
@@ -93,13 +121,11 @@ func TestHandler_Get(t *testing.T) {
 	}{
 		{
 			name: "Get gauge ok",
-			MemStorage: &storage.MemStorage{
-				Metrics: &metrics.Metrics{
-					Gauges: map[metrics.Name]metrics.Gauge{
-						"Alloc": 1221.23,
-					},
+			MemStorage: memStorage(metrics.Metrics{
+				Gauges: map[metrics.Name]metrics.Gauge{
+					"Alloc": 1221.23,
 				},
-			},
+			}),
 			request: "/value/gauge/Alloc",
 			want: want{
 				statusCode: http.StatusOK,
@@ -108,22 +134,20 @@ func TestHandler_Get(t *testing.T) {
 		},
 		{
 			name:       "Get gauge not found",
-			MemStorage: &storage.MemStorage{Metrics: &metrics.Metrics{}},
+			MemStorage: storage.New(),
 			request:    "/value/gauge/NotFound",
 			want: want{
 				statusCode: http.StatusNotFound,
-				value:      "metric not implemented\n",
+				value:      "NotFound - metric not found\n",
 			},
 		},
 		{
 			name: "Get counter ok",
-			MemStorage: &storage.MemStorage{
-				Metrics: &metrics.Metrics{
-					Counters: map[metrics.Name]metrics.Counter{
-						"PollCount": 42,
-					},
+			MemStorage: memStorage(metrics.Metrics{
+				Counters: map[metrics.Name]metrics.Counter{
+					"PollCount": 42,
 				},
-			},
+			}),
 			request: "/value/counter/PollCount",
 			want: want{
 				statusCode: http.StatusOK,
@@ -132,16 +156,16 @@ func TestHandler_Get(t *testing.T) {
 		},
 		{
 			name:       "Get counter not found",
-			MemStorage: &storage.MemStorage{Metrics: &metrics.Metrics{}},
+			MemStorage: storage.New(),
 			request:    "/value/counter/NotFound",
 			want: want{
 				statusCode: http.StatusNotFound,
-				value:      "metric not implemented\n",
+				value:      "NotFound - metric not found\n",
 			},
 		},
 		{
 			name:       "Not implemented",
-			MemStorage: &storage.MemStorage{},
+			MemStorage: storage.New(),
 			request:    "/value/not/implemented",
 			want: want{
 				statusCode: http.StatusNotImplemented,
@@ -201,3 +225,644 @@ func TestHandler_List(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_AgentConfig(t *testing.T) {
+	type want struct {
+		statusCode int
+		value      string
+	}
+	tests := []struct {
+		name        string
+		agentConfig *agentconfig.File
+		request     string
+		want        want
+	}{
+		{
+			name:    "Agent config not set",
+			request: "/agent-config?id=web-1",
+			want: want{
+				statusCode: http.StatusNotFound,
+				value:      "agent config is not set\n",
+			},
+		},
+		{
+			name: "Agent settings",
+			agentConfig: &agentconfig.File{
+				Default: agentconfig.Settings{PollInterval: 2},
+				Groups:  map[string]agentconfig.Settings{"web": {ReportInterval: 20}},
+			},
+			request: "/agent-config?id=web-1&group=web",
+			want: want{
+				statusCode: http.StatusOK,
+				value:      "{\"poll_interval\":2,\"report_interval\":20}\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := New(chi.NewRouter(), nil, "", false, "")
+			if tt.agentConfig != nil {
+				handler.WithAgentConfig(tt.agentConfig)
+			}
+
+			ts := httptest.NewServer(handler.GetRouter())
+			defer ts.Close()
+
+			resp, body := testRequest(t, ts, http.MethodGet, tt.request)
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.value, body)
+
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestHandler_JSONUpdateKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		statusCode int
+	}{
+		{
+			name:       "Signed with the new key",
+			key:        "new",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Signed with the old key",
+			key:        "old",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Signed with an unknown key",
+			key:        "other",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := New(chi.NewRouter(), nil, "", false, "old")
+			handler.WithKeys("new", "old")
+
+			ts := httptest.NewServer(handler.GetRouter())
+			defer ts.Close()
+
+			body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"hash":%q}`,
+				metrics.CounterHash(tt.key, "PollCount", 1))
+			resp, err := http.Post(ts.URL+"/update/", "application/json", strings.NewReader(body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_ServerMetrics(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/server_storage_size")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", body)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/value/counter/server_http_requests_POST_update_type_name_value")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, "0", body)
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/")
+	resp.Body.Close()
+	assert.Contains(t, body, "server_ingested_gauge")
+
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/gauge/server_storage_size/5")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandler_Expiry(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	data, err := json.Marshal(map[string]interface{}{
+		"Gauges":    map[metrics.Name]metrics.Gauge{"FreeMemory": 42, "Alloc": 1},
+		"UpdatedAt": map[metrics.Name]time.Time{"FreeMemory": old, "Alloc": time.Now()},
+	})
+	require.NoError(t, err)
+	st := storage.New()
+	require.NoError(t, json.Unmarshal(data, st))
+
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	handler.WithStorage(st)
+	handler.WithExpiry(time.Minute, 0)
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodGet, "/value/gauge/FreeMemory")
+	resp.Body.Close()
+	assert.Equal(t, "true", resp.Header.Get("X-Metric-Stale"))
+	assert.Equal(t, old.UTC().Format(http.TimeFormat), resp.Header.Get("Last-Modified"))
+
+	resp, _ = testRequest(t, ts, http.MethodGet, "/value/gauge/Alloc")
+	resp.Body.Close()
+	assert.Empty(t, resp.Header.Get("X-Metric-Stale"))
+
+	resp, err = http.Post(ts.URL+"/value/", "application/json", strings.NewReader(`{"id":"FreeMemory","type":"gauge"}`))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"stale":true`)
+
+	resp, list := testRequest(t, ts, http.MethodGet, "/")
+	resp.Body.Close()
+	assert.Contains(t, list, "FreeMemory - 42 bytes (stale, updated")
+	assert.NotContains(t, list, "Alloc - 1 bytes (stale")
+
+	handler.WithExpiry(time.Minute, 30*time.Minute)
+	require.NoError(t, handler.Expire(context.Background()))
+	resp, _ = testRequest(t, ts, http.MethodGet, "/value/gauge/FreeMemory")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHandler_Heartbeat(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	handler.WithExpiry(time.Minute, 0)
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", strings.NewReader(`[]`))
+	require.NoError(t, err)
+	req.Header.Set("X-Agent-ID", "web-1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/server_agent_up_web-1")
+	resp.Body.Close()
+	assert.Equal(t, "1", body)
+
+	handler.mu.Lock()
+	handler.agents["web-1"] = time.Now().Add(-time.Hour)
+	handler.mu.Unlock()
+
+	resp, body = testRequest(t, ts, http.MethodGet, "/value/gauge/server_agent_up_web-1")
+	resp.Body.Close()
+	assert.Equal(t, "0", body)
+}
+
+// lookupStorage fails the test when a single value needs all timestamps.
+type lookupStorage struct {
+	storage.Repositories
+	t *testing.T
+}
+
+func (s lookupStorage) Updated(ctx context.Context) (map[metrics.Name]time.Time, error) {
+	s.t.Error("all timestamps read for a single value")
+	return s.Repositories.Updated(ctx)
+}
+
+func TestHandler_ValueUpdatedAt(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	handler.WithStorage(lookupStorage{Repositories: handler.Storage, t: t})
+	handler.WithExpiry(time.Minute, 0)
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1")
+	resp.Body.Close()
+
+	resp, _ = testRequest(t, ts, http.MethodGet, "/value/gauge/Alloc")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err := http.Post(ts.URL+"/value/", "application/json", strings.NewReader(`{"id":"Alloc","type":"gauge"}`))
+	require.NoError(t, err)
+	var m Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	resp.Body.Close()
+	require.NotNil(t, m.Updated)
+	assert.WithinDuration(t, time.Now(), *m.Updated, time.Minute)
+}
+
+func TestHandler_HeartbeatLimit(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	beat := func(id string) {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		req.Header.Set(agentHeader, id)
+		handler.heartbeat(next).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for i := 0; i < maxAgents; i++ {
+		beat(fmt.Sprintf("agent-%d", i))
+	}
+	handler.mu.Lock()
+	handler.agents["agent-0"] = time.Now().Add(-time.Hour)
+	handler.mu.Unlock()
+
+	beat("agent-0")
+	beat("one-too-many")
+	beat(strings.Repeat("x", maxAgentIDLen+1))
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	assert.Len(t, handler.agents, maxAgents)
+	assert.WithinDuration(t, time.Now(), handler.agents["agent-0"], time.Minute, "known agents are refreshed")
+	assert.NotContains(t, handler.agents, "one-too-many")
+}
+
+func TestHandler_Admin(t *testing.T) {
+	newStorage := func() *storage.MemStorage {
+		return memStorage(metrics.Metrics{
+			Gauges:   map[metrics.Name]metrics.Gauge{"Alloc": 1, "TestGauge": 2, "TestGauge2": 3},
+			Counters: map[metrics.Name]metrics.Counter{"PollCount": 5, "TestCounter": 6},
+		})
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		request    string
+		statusCode int
+		body       string
+		check      func(t *testing.T, st *storage.MemStorage)
+	}{
+		{
+			name:       "Delete gauge",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/gauge/Alloc",
+			statusCode: http.StatusOK,
+			check: func(t *testing.T, st *storage.MemStorage) {
+				_, err := st.Get(context.Background(), "Alloc")
+				assert.ErrorIs(t, err, storage.ErrNotFound)
+			},
+		},
+		{
+			name:       "Delete with the wrong type",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/counter/Alloc",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Delete reserved name",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/gauge/server_storage_size",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Reset counter",
+			token:      "admin",
+			method:     http.MethodPost,
+			request:    "/value/counter/PollCount/reset",
+			statusCode: http.StatusOK,
+			check: func(t *testing.T, st *storage.MemStorage) {
+				val, err := st.Get(context.Background(), "PollCount")
+				require.NoError(t, err)
+				assert.Equal(t, metrics.Counter(0), val)
+			},
+		},
+		{
+			name:       "Reset unknown counter",
+			token:      "admin",
+			method:     http.MethodPost,
+			request:    "/value/counter/Alloc/reset",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Delete by pattern",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/?pattern=Test*",
+			statusCode: http.StatusOK,
+			body:       `{"deleted":["TestCounter","TestGauge","TestGauge2"]}`,
+			check: func(t *testing.T, st *storage.MemStorage) {
+				mcs, err := st.GetMetrics(context.Background())
+				require.NoError(t, err)
+				assert.Len(t, mcs.Gauges, 1)
+				assert.Len(t, mcs.Counters, 1)
+			},
+		},
+		{
+			name:       "Delete by pattern and type",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/?pattern=Test*&type=counter",
+			statusCode: http.StatusOK,
+			body:       `{"deleted":["TestCounter"]}`,
+		},
+		{
+			name:       "Delete by bad pattern",
+			token:      "admin",
+			method:     http.MethodDelete,
+			request:    "/value/?pattern=[",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Wrong token",
+			token:      "other",
+			method:     http.MethodDelete,
+			request:    "/value/gauge/Alloc",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "Admin API disabled",
+			method:     http.MethodDelete,
+			request:    "/value/gauge/Alloc",
+			statusCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newStorage()
+			handler := New(chi.NewRouter(), nil, "", false, "")
+			handler.WithStorage(st)
+			if tt.token != "" {
+				handler.WithAdminToken("admin")
+			}
+
+			ts := httptest.NewServer(handler.GetRouter())
+			defer ts.Close()
+
+			req, err := http.NewRequest(tt.method, ts.URL+tt.request, nil)
+			require.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.body != "" {
+				assert.JSONEq(t, tt.body, string(body))
+			}
+			if tt.check != nil {
+				tt.check(t, st)
+			}
+		})
+	}
+}
+
+func TestHandler_Meta(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	handler.WithAdminToken("admin")
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	body := `[{"id":"QueueSize","type":"gauge","value":3,"unit":"jobs","help":"Jobs waiting"},{"id":"HeapAlloc","type":"gauge","value":1}]`
+	resp, err := http.Post(ts.URL+"/updates/", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, meta := testRequest(t, ts, http.MethodGet, "/meta/QueueSize")
+	resp.Body.Close()
+	assert.JSONEq(t, `{"type":"gauge","unit":"jobs","help":"Jobs waiting"}`, meta)
+
+	resp, list := testRequest(t, ts, http.MethodGet, "/meta/")
+	resp.Body.Close()
+	assert.Contains(t, list, `"HeapAlloc":{"type":"gauge","unit":"bytes"`)
+
+	resp, err = http.Post(ts.URL+"/value/", "application/json", strings.NewReader(`{"id":"HeapAlloc","type":"gauge"}`))
+	require.NoError(t, err)
+	value, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(value), `"unit":"bytes"`)
+
+	// A gauge can't be sent as a counter, nothing of the batch is stored.
+	body = `[{"id":"Other","type":"gauge","value":1},{"id":"QueueSize","type":"counter","delta":1}]`
+	resp, err = http.Post(ts.URL+"/updates/", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = testRequest(t, ts, http.MethodGet, "/value/gauge/Other")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/meta/QueueSize", strings.NewReader(`{"type":"counter","help":"Jobs done"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The stored gauge keeps its type until it's deleted.
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/counter/QueueSize/1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/value/gauge/QueueSize", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/counter/QueueSize/1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHandler_TypeConflict(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/counter/Jobs/3")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tests := []struct {
+		name       string
+		method     string
+		request    string
+		body       string
+		statusCode int
+		want       string
+	}{
+		{
+			name:       "Post gauge over counter",
+			method:     http.MethodPost,
+			request:    "/update/gauge/Jobs/1.5",
+			statusCode: http.StatusConflict,
+			want:       "metric Jobs is a counter, not a gauge",
+		},
+		{
+			name:       "JSON gauge over counter",
+			method:     http.MethodPost,
+			request:    "/update/",
+			body:       `{"id":"Jobs","type":"gauge","value":1.5}`,
+			statusCode: http.StatusConflict,
+			want:       "metric Jobs is a counter, not a gauge",
+		},
+		{
+			name:       "Batch with both types",
+			method:     http.MethodPost,
+			request:    "/updates/",
+			body:       `[{"id":"Queue","type":"gauge","value":1},{"id":"Queue","type":"counter","delta":1}]`,
+			statusCode: http.StatusConflict,
+			want:       "metric Queue is a gauge, not a counter",
+		},
+		{
+			name:       "Get counter as gauge",
+			method:     http.MethodGet,
+			request:    "/value/gauge/Jobs",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "JSON get counter as gauge",
+			method:     http.MethodPost,
+			request:    "/value/",
+			body:       `{"id":"Jobs","type":"gauge"}`,
+			statusCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.request, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.Contains(t, string(body), tt.want)
+		})
+	}
+
+	resp, value := testRequest(t, ts, http.MethodGet, "/value/counter/Jobs")
+	resp.Body.Close()
+	assert.Equal(t, "3", value)
+	resp, _ = testRequest(t, ts, http.MethodGet, "/value/gauge/Queue")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// countingStorage counts the writes that reach the storage.
+type countingStorage struct {
+	storage.Repositories
+	puts, batches int
+}
+
+func (s *countingStorage) Put(ctx context.Context, key string, val interface{}) error {
+	s.puts++
+	return s.Repositories.Put(ctx, key, val)
+}
+
+func (s *countingStorage) PutMetrics(ctx context.Context, m metrics.Metrics) error {
+	s.batches++
+	return s.Repositories.PutMetrics(ctx, m)
+}
+
+func TestHandler_BatchUpdate(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	counting := &countingStorage{Repositories: handler.Storage}
+	handler.Storage = counting
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		batches    int
+	}{
+		{
+			name:       "Batch is stored at once",
+			body:       `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":2},{"id":"PollCount","type":"counter","delta":3}]`,
+			statusCode: http.StatusOK,
+			batches:    1,
+		},
+		{
+			name:       "Unknown type stores nothing",
+			body:       `[{"id":"Frees","type":"gauge","value":1},{"id":"PollCount","type":"histogram","delta":1}]`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Missing value stores nothing",
+			body:       `[{"id":"Frees","type":"gauge","value":1},{"id":"PollCount","type":"counter"}]`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counting.puts, counting.batches = 0, 0
+
+			resp, err := http.Post(ts.URL+"/updates/", "application/json", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.Equal(t, 0, counting.puts)
+			assert.Equal(t, tt.batches, counting.batches)
+		})
+	}
+
+	mcs, err := handler.Storage.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 1.5}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 5}, mcs.Counters)
+}
+
+func TestHandler_Rules(t *testing.T) {
+	handler := New(chi.NewRouter(), nil, "", false, "")
+	handler.WithRules([]Rule{
+		{Match: "debug_keep"},
+		{Match: "debug_*", Drop: true},
+		{Match: "Tmp", Drop: true},
+	})
+	ts := httptest.NewServer(handler.GetRouter())
+	defer ts.Close()
+
+	for _, path := range []string{
+		"/update/gauge/debug_heap/1",
+		"/update/gauge/debug_keep/2",
+		"/update/counter/Tmp/3",
+		"/update/counter/Tmpfiles/4",
+	} {
+		resp, _ := testRequest(t, ts, http.MethodPost, path)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+
+	for _, body := range []string{
+		`{"id":"debug_json","type":"gauge","value":5}`,
+		`[{"id":"debug_batch","type":"gauge","value":6},{"id":"Alloc","type":"gauge","value":7}]`,
+	} {
+		path := "/update/"
+		if strings.HasPrefix(body, "[") {
+			path = "/updates/"
+		}
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, body)
+	}
+
+	mcs, err := handler.Storage.GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"debug_keep": 2, "Alloc": 7}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"Tmpfiles": 4}, mcs.Counters)
+
+	// Rules are replaced on reload.
+	handler.WithRules(nil)
+	resp, _ := testRequest(t, ts, http.MethodPost, "/update/gauge/debug_heap/1")
+	resp.Body.Close()
+	_, err = handler.Storage.Get(context.Background(), "debug_heap")
+	assert.NoError(t, err)
+}
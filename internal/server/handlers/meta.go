@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+// unitHeader carries the unit of a value read as plain text.
+const unitHeader = "X-Metric-Unit"
+
+// conflict rejects a value sent with another type than the metric is stored
+// or described with.
+func (h *Handler) conflict(ctx context.Context, w http.ResponseWriter, name, mtype string) bool {
+	if mtype != metrics.TypeGauge && mtype != metrics.TypeCounter {
+		return false
+	}
+
+	known := ""
+	if val, err := h.Storage.Get(ctx, name); err == nil {
+		known = storage.TypeOf(val)
+	} else if meta, ok := h.meta.Get(metrics.Name(name)); ok {
+		known = meta.Type
+	}
+	if known == "" || known == mtype {
+		return false
+	}
+	http.Error(w, storage.TypeConflict(name, known, mtype).Error(), http.StatusConflict)
+	return true
+}
+
+// describe keeps the unit and help sent with a value.
+func (h *Handler) describe(m Metrics) {
+	if m.Unit == "" && m.Help == "" || h.dropped(m.ID) {
+		return
+	}
+	meta := metrics.Meta{Type: m.MType, Unit: m.Unit, Help: m.Help}
+	if known, ok := h.meta.Get(metrics.Name(m.ID)); ok && known == meta {
+		return
+	}
+	h.meta.Set(metrics.Name(m.ID), meta)
+}
+
+// Meta responds with the metadata of a metric.
+func (h *Handler) Meta(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	meta, ok := h.meta.Get(metrics.Name(name))
+	if !ok {
+		http.Error(w, fmt.Sprintf("no metadata for metric %s", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, meta)
+}
+
+// MetaList responds with the metadata of every stored metric that has one.
+func (h *Handler) MetaList(w http.ResponseWriter, r *http.Request) {
+	mcs, err := h.getMetrics(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	all := h.meta.All()
+	for k := range mcs.Gauges {
+		if meta, ok := h.meta.Get(k); ok {
+			all[k] = meta
+		}
+	}
+	for k := range mcs.Counters {
+		if meta, ok := h.meta.Get(k); ok {
+			all[k] = meta
+		}
+	}
+	writeJSON(w, all)
+}
+
+// SetMeta replaces the metadata of a metric.
+func (h *Handler) SetMeta(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if reserved(w, name) {
+		return
+	}
+
+	var meta metrics.Meta
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if meta.Type != metrics.TypeGauge && meta.Type != metrics.TypeCounter {
+		http.Error(w, "Incorrect metric type", http.StatusBadRequest)
+		return
+	}
+
+	h.meta.Set(metrics.Name(name), meta)
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"strings"
+)
+
+// Rule tells whether updates of the metrics matching Match, a name or a
+// prefix ending with "*", are dropped.
+type Rule struct {
+	Match string
+	Drop  bool
+}
+
+func (r Rule) matches(name string) bool {
+	if prefix := strings.TrimSuffix(r.Match, "*"); prefix != r.Match {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == r.Match
+}
+
+// WithRules replaces the ingestion rules. The first rule matching a metric
+// applies, a metric no rule matches is stored. Updates of dropped metrics
+// are acknowledged, so agents don't retry them, but not stored.
+func (h *Handler) WithRules(rules []Rule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules = rules
+}
+
+func (h *Handler) dropped(name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, r := range h.rules {
+		if r.matches(name) {
+			return r.Drop
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/server/telemetry"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"net/http"
+)
+
+// put stores a metric sent by a client and counts it as ingested.
+func (h *Handler) put(ctx context.Context, name string, val interface{}) error {
+	if h.dropped(name) {
+		telemetry.Dropped(1)
+		return nil
+	}
+
+	err := h.Storage.Put(ctx, name, val)
+	if err != nil {
+		return err
+	}
+
+	switch val.(type) {
+	case metrics.Gauge:
+		telemetry.Ingested(metrics.TypeGauge, 1)
+	case metrics.Counter:
+		telemetry.Ingested(metrics.TypeCounter, 1)
+	}
+	return nil
+}
+
+// putMetrics stores a batch at once, either every value is stored or none.
+func (h *Handler) putMetrics(ctx context.Context, m metrics.Metrics) error {
+	dropped := 0
+	for k := range m.Gauges {
+		if h.dropped(string(k)) {
+			delete(m.Gauges, k)
+			dropped++
+		}
+	}
+	for k := range m.Counters {
+		if h.dropped(string(k)) {
+			delete(m.Counters, k)
+			dropped++
+		}
+	}
+	telemetry.Dropped(dropped)
+
+	if err := h.Storage.PutMetrics(ctx, m); err != nil {
+		return err
+	}
+
+	telemetry.Ingested(metrics.TypeGauge, len(m.Gauges))
+	telemetry.Ingested(metrics.TypeCounter, len(m.Counters))
+	return nil
+}
+
+// get reads a stored metric or, under the reserved namespace, a server
+// metric. A metric of another type is not found.
+func (h *Handler) get(ctx context.Context, mtype, name string) (interface{}, error) {
+	val, err := h.getAny(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if stored := storage.TypeOf(val); stored != mtype {
+		return nil, fmt.Errorf("metric %s is a %s - %w", name, stored, storage.ErrNotFound)
+	}
+	return val, nil
+}
+
+func (h *Handler) getAny(ctx context.Context, name string) (interface{}, error) {
+	if !telemetry.Reserved(name) {
+		return h.Storage.Get(ctx, name)
+	}
+
+	mcs, err := h.getMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if delta, ok := mcs.Counters[metrics.Name(name)]; ok {
+		return delta, nil
+	}
+	if value, ok := mcs.Gauges[metrics.Name(name)]; ok {
+		return value, nil
+	}
+	return nil, storage.NotFound(name)
+}
+
+// getMetrics returns the stored metrics together with the server metrics.
+func (h *Handler) getMetrics(ctx context.Context) (metrics.Metrics, error) {
+	stored, err := h.Storage.GetMetrics(ctx)
+	if err != nil {
+		return stored, err
+	}
+
+	mcs := telemetry.Metrics(len(stored.Gauges) + len(stored.Counters))
+	for k, v := range stored.Gauges {
+		mcs.Gauges[k] = v
+	}
+	for k, v := range stored.Counters {
+		mcs.Counters[k] = v
+	}
+	h.addAgentMetrics(mcs)
+	return mcs, nil
+}
+
+// reserved rejects a write to the server metrics namespace.
+func reserved(w http.ResponseWriter, name string) bool {
+	if !telemetry.Reserved(name) {
+		return false
+	}
+	msg := fmt.Sprintf("metric name %s is reserved, prefix %s belongs to the server metrics", name, telemetry.Namespace)
+	http.Error(w, msg, http.StatusBadRequest)
+	return true
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/server/telemetry"
+	"github.com/Osselnet/metrics-collector/internal/storage"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
 	"github.com/go-chi/chi/v5"
+	"html"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 )
 
 type Metrics struct {
@@ -18,6 +22,11 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	Unit  string   `json:"unit,omitempty"`  // единица измерения
+	Help  string   `json:"help,omitempty"`  // описание метрики
+
+	Updated *time.Time `json:"updated,omitempty"` // время последнего обновления метрики
+	Stale   bool       `json:"stale,omitempty"`   // метрика не обновлялась дольше stale_after
 }
 
 func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
@@ -25,6 +34,10 @@ func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	value := chi.URLParam(r, "value")
 
+	if reserved(w, name) || h.conflict(r.Context(), w, name, metricType) {
+		return
+	}
+
 	switch metricType {
 	case "gauge":
 		var gauge metrics.Gauge
@@ -34,7 +47,10 @@ func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
-		h.Storage.Put(r.Context(), name, gauge)
+		if err := h.put(r.Context(), name, gauge); err != nil {
+			storageError(w, err)
+			return
+		}
 	case "counter":
 		var counter metrics.Counter
 		err := counter.FromString(value)
@@ -43,7 +59,10 @@ func (h *Handler) Post(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
-		h.Storage.Put(r.Context(), name, counter)
+		if err := h.put(r.Context(), name, counter); err != nil {
+			storageError(w, err)
+			return
+		}
 	default:
 		err := fmt.Errorf("not implemented")
 		http.Error(w, err.Error(), http.StatusNotImplemented)
@@ -60,14 +79,14 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 
 	switch metricType {
 	case "gauge":
-		gauge, err := h.Storage.Get(r.Context(), name)
+		gauge, err := h.get(r.Context(), metrics.TypeGauge, name)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 		val = strconv.FormatFloat(float64(gauge.(metrics.Gauge)), 'f', -1, 64)
 	case "counter":
-		counter, err := h.Storage.Get(r.Context(), name)
+		counter, err := h.get(r.Context(), metrics.TypeCounter, name)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -79,6 +98,15 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if meta, ok := h.meta.Get(metrics.Name(name)); ok && meta.Unit != "" {
+		w.Header().Set(unitHeader, meta.Unit)
+	}
+	if updated := h.updated(r.Context(), name); !updated.IsZero() {
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		if h.stale(updated) {
+			w.Header().Set(staleHeader, "true")
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(val))
 }
@@ -95,12 +123,35 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 		value float64
 	}
 
-	mcs, err := h.Storage.GetMetrics(r.Context())
+	mcs, err := h.getMetrics(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	updated, err := h.Storage.Updated(r.Context())
+	if err != nil {
+		log.Println("Could not read metric timestamps", err)
+	}
+	state := func(name metrics.Name) string {
+		if t := updated[name]; h.stale(t) {
+			return fmt.Sprintf(" (stale, updated %s)", t.Format(time.RFC3339))
+		}
+		return ""
+	}
+	// The unit follows the value, the help shows on hover.
+	describe := func(name metrics.Name) (string, string) {
+		meta, _ := h.meta.Get(name)
+		var unit, title string
+		if meta.Unit != "" {
+			unit = " " + meta.Unit
+		}
+		if meta.Help != "" {
+			title = fmt.Sprintf(` title="%s"`, html.EscapeString(meta.Help))
+		}
+		return unit, title
+	}
+
 	gauges := make([]gauge, 0, metrics.GaugeLen)
 	for k, val := range mcs.Gauges {
 		gauges = append(gauges, gauge{key: string(k), value: float64(val)})
@@ -110,13 +161,15 @@ func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
 	b.WriteString(`<div><h2>Gauges</h2>`)
 	for _, g := range gauges {
 		val := strconv.FormatFloat(g.value, 'f', -1, 64)
-		b.WriteString(fmt.Sprintf("<div>%s - %v</div>", g.key, val))
+		unit, title := describe(metrics.Name(g.key))
+		b.WriteString(fmt.Sprintf("<div%s>%s - %v%s%s</div>", title, g.key, val, unit, state(metrics.Name(g.key))))
 	}
 	b.WriteString(`</div>`)
 
 	b.WriteString(`<div><h2>Counters</h2>`)
 	for k, val := range mcs.Counters {
-		b.WriteString(fmt.Sprintf("<div>%s - %d</div>", k, val))
+		unit, title := describe(k)
+		b.WriteString(fmt.Sprintf("<div%s>%s - %d%s%s</div>", title, k, val, unit, state(k)))
 	}
 	b.WriteString(`</div>`)
 
@@ -135,29 +188,37 @@ func (h *Handler) JSONValue(w http.ResponseWriter, r *http.Request) {
 
 	switch m.MType {
 	case "counter":
-		counter, err := h.Storage.Get(r.Context(), m.ID)
+		counter, err := h.get(r.Context(), metrics.TypeCounter, m.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 		v := int64(counter.(metrics.Counter))
 		m.Delta = &v
-		if h.key != "" {
-			m.Hash = metrics.CounterHash(h.key, m.ID, *m.Delta)
+		if key := h.signKey(); key != "" {
+			m.Hash = metrics.CounterHash(key, m.ID, *m.Delta)
 		}
 	case "gauge":
-		gauge, err := h.Storage.Get(r.Context(), m.ID)
+		gauge, err := h.get(r.Context(), metrics.TypeGauge, m.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
 		v := float64(gauge.(metrics.Gauge))
 		m.Value = &v
-		if h.key != "" {
-			m.Hash = metrics.GaugeHash(h.key, m.ID, *m.Value)
+		if key := h.signKey(); key != "" {
+			m.Hash = metrics.GaugeHash(key, m.ID, *m.Value)
 		}
 	}
 
+	if meta, ok := h.meta.Get(metrics.Name(m.ID)); ok {
+		m.Unit, m.Help = meta.Unit, meta.Help
+	}
+	if updated := h.updated(r.Context(), m.ID); !updated.IsZero() {
+		m.Updated = &updated
+		m.Stale = h.stale(updated)
+	}
+
 	resp, err := json.Marshal(m)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -185,34 +246,48 @@ func (h *Handler) JSONUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if reserved(w, m.ID) || h.conflict(r.Context(), w, m.ID, m.MType) {
+		return
+	}
+
 	switch m.MType {
 	case metrics.TypeCounter:
 		if m.Delta == nil {
 			http.Error(w, "metric value should not be empty", http.StatusBadRequest)
 			return
 		}
-		if h.key != "" && m.Hash != "" {
-			if metrics.CounterHash(h.key, m.ID, *m.Delta) != m.Hash {
-				err = fmt.Errorf("hash check failed for counter metric")
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+		if m.Hash != "" && !h.validHash(m.Hash, func(key string) string {
+			return metrics.CounterHash(key, m.ID, *m.Delta)
+		}) {
+			telemetry.HashFailure()
+			err = fmt.Errorf("hash check failed for counter metric")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.put(r.Context(), m.ID, metrics.Counter(*m.Delta)); err != nil {
+			storageError(w, err)
+			return
 		}
-		h.Storage.Put(r.Context(), m.ID, metrics.Counter(*m.Delta))
+		h.describe(m)
 		w.WriteHeader(http.StatusOK)
 	case metrics.TypeGauge:
 		if m.Value == nil {
 			http.Error(w, "metric value should not be empty", http.StatusBadRequest)
 			return
 		}
-		if h.key != "" && m.Hash != "" {
-			if metrics.GaugeHash(h.key, m.ID, *m.Value) != m.Hash {
-				err = fmt.Errorf("hash check failed for gauge metric")
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+		if m.Hash != "" && !h.validHash(m.Hash, func(key string) string {
+			return metrics.GaugeHash(key, m.ID, *m.Value)
+		}) {
+			telemetry.HashFailure()
+			err = fmt.Errorf("hash check failed for gauge metric")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.put(r.Context(), m.ID, metrics.Gauge(*m.Value)); err != nil {
+			storageError(w, err)
+			return
 		}
-		h.Storage.Put(r.Context(), m.ID, metrics.Gauge(*m.Value))
+		h.describe(m)
 		w.WriteHeader(http.StatusOK)
 	default:
 		http.Error(w, "Incorrect metric type", http.StatusBadRequest)
@@ -248,29 +323,51 @@ func (h *Handler) HandleBatchUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Nothing is stored when a name is reserved, a value is missing or sent
+	// with the wrong type, also within the batch.
+	batch := metrics.New()
+	types := make(map[string]string, len(m))
 	for _, v := range m {
+		if reserved(w, v.ID) || h.conflict(r.Context(), w, v.ID, v.MType) {
+			return
+		}
+		if mtype, ok := types[v.ID]; ok && mtype != v.MType {
+			http.Error(w, storage.TypeConflict(v.ID, mtype, v.MType).Error(), http.StatusConflict)
+			return
+		}
+		types[v.ID] = v.MType
+
 		switch v.MType {
 		case metrics.TypeCounter:
 			if v.Delta == nil {
 				http.Error(w, "metric value should not be empty", http.StatusBadRequest)
 				return
 			}
-			h.Storage.Put(r.Context(), v.ID, metrics.Counter(*v.Delta))
+			batch.Counters[metrics.Name(v.ID)] += metrics.Counter(*v.Delta)
 		case metrics.TypeGauge:
 			if v.Value == nil {
 				http.Error(w, "metric value should not be empty", http.StatusBadRequest)
 				return
 			}
-			h.Storage.Put(r.Context(), v.ID, metrics.Gauge(*v.Value))
+			batch.Gauges[metrics.Name(v.ID)] = metrics.Gauge(*v.Value)
 		default:
 			http.Error(w, "Incorrect metric type", http.StatusBadRequest)
+			return
 		}
 	}
+
+	if err := h.putMetrics(r.Context(), *batch); err != nil {
+		storageError(w, err)
+		return
+	}
+	for _, v := range m {
+		h.describe(v)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) hashCheck(m *Metrics) error {
-	if h.key == "" {
+	if h.signKey() == "" {
 		return nil
 	}
 	switch m.MType {
@@ -279,11 +376,9 @@ func (h *Handler) hashCheck(m *Metrics) error {
 			m.Value = new(float64)
 		}
 
-		mac1 := m.Hash
-		mac2 := metrics.GaugeHash(h.key, m.ID, *m.Value)
-		if mac1 != mac2 {
-			log.Printf(":: mac1 - %s\n", mac1)
-			log.Printf(":: mac2 - %s\n", mac2)
+		if !h.validHash(m.Hash, func(key string) string { return metrics.GaugeHash(key, m.ID, *m.Value) }) {
+			log.Printf(":: mac1 - %s\n", m.Hash)
+			telemetry.HashFailure()
 			return fmt.Errorf("hash check failed for gauge metric")
 		}
 	case "counter":
@@ -291,9 +386,8 @@ func (h *Handler) hashCheck(m *Metrics) error {
 			m.Delta = new(int64)
 		}
 
-		mac1 := m.Hash
-		mac2 := metrics.CounterHash(h.key, m.ID, *m.Delta)
-		if mac1 != mac2 {
+		if !h.validHash(m.Hash, func(key string) string { return metrics.CounterHash(key, m.ID, *m.Delta) }) {
+			telemetry.HashFailure()
 			return fmt.Errorf("hash check failed for counter metric")
 		}
 	default:
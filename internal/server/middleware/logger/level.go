@@ -0,0 +1,19 @@
+package logger
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+// SetLevel changes the request log level, it can be called while the
+// server is running.
+func SetLevel(text string) error {
+	l, err := zapcore.ParseLevel(text)
+	if err != nil {
+		return err
+	}
+	level.SetLevel(l)
+	return nil
+}
@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"github.com/Osselnet/metrics-collector/internal/server/telemetry"
+	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 	"net/http"
 	"time"
@@ -30,12 +32,14 @@ func (r *loggingResponseWriter) WriteHeader(statusCode int) {
 }
 
 func LogHandler(h http.Handler) http.Handler {
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = level
+	logger, _ := cfg.Build()
+	sugar := logger.Sugar()
+
 	logFn := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		logger, _ := zap.NewDevelopment()
-		sugar := logger.Sugar()
-
 		responseData := &responseData{
 			status: 0,
 			size:   0,
@@ -48,6 +52,12 @@ func LogHandler(h http.Handler) http.Handler {
 
 		duration := time.Since(start)
 
+		var pattern string
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			pattern = rctx.RoutePattern()
+		}
+		telemetry.Request(r.Method, pattern, duration)
+
 		sugar.Infoln(
 			"uri", r.RequestURI,
 			"method", r.Method,
@@ -0,0 +1,117 @@
+// Package telemetry counts what the server itself does. The values are
+// served under the reserved Namespace next to the stored metrics, counters
+// are totals since start and durations are summed in seconds.
+package telemetry
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Namespace is the name prefix of the server metrics, clients can't write
+// metrics under it.
+const Namespace = "server_"
+
+const (
+	HashFailures   = metrics.Name(Namespace + "hash_failures")
+	DroppedUpdates = metrics.Name(Namespace + "dropped_updates")
+	DBQueries      = metrics.Name(Namespace + "db_queries")
+	DBQuerySeconds = metrics.Name(Namespace + "db_query_seconds")
+	DBRetries      = metrics.Name(Namespace + "db_retries")
+	StorageSize    = metrics.Name(Namespace + "storage_size")
+
+	requests       = Namespace + "http_requests_"
+	requestSeconds = Namespace + "http_request_seconds_"
+	ingested       = Namespace + "ingested_"
+)
+
+var (
+	mu       sync.Mutex
+	counters = make(map[metrics.Name]metrics.Counter)
+	gauges   = make(map[metrics.Name]metrics.Gauge)
+)
+
+// Reserved tells whether name belongs to the server metrics.
+func Reserved(name string) bool {
+	return strings.HasPrefix(name, Namespace)
+}
+
+// Request records a request handled by the route pattern, e.g.
+// "POST /updates/" is counted as server_http_requests_POST_updates.
+func Request(method, pattern string, d time.Duration) {
+	route := method + "_" + routeName(pattern)
+
+	mu.Lock()
+	defer mu.Unlock()
+	counters[metrics.Name(requests+route)]++
+	gauges[metrics.Name(requestSeconds+route)] += metrics.Gauge(d.Seconds())
+}
+
+// Ingested records n stored values of the metric type.
+func Ingested(mtype string, n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	counters[metrics.Name(ingested+mtype)] += metrics.Counter(n)
+}
+
+// Dropped records n updates discarded by the ingestion rules.
+func Dropped(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	counters[DroppedUpdates] += metrics.Counter(n)
+}
+
+func HashFailure() {
+	mu.Lock()
+	defer mu.Unlock()
+	counters[HashFailures]++
+}
+
+func Query(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	counters[DBQueries]++
+	gauges[DBQuerySeconds] += metrics.Gauge(d.Seconds())
+}
+
+func Retry() {
+	mu.Lock()
+	defer mu.Unlock()
+	counters[DBRetries]++
+}
+
+// Metrics returns a copy of the server metrics with the number of stored
+// metrics.
+func Metrics(storageSize int) metrics.Metrics {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m := metrics.Metrics{
+		Gauges:   make(map[metrics.Name]metrics.Gauge, len(gauges)+1),
+		Counters: make(map[metrics.Name]metrics.Counter, len(counters)),
+	}
+	for k, v := range gauges {
+		m.Gauges[k] = v
+	}
+	for k, v := range counters {
+		m.Counters[k] = v
+	}
+	m.Gauges[StorageSize] = metrics.Gauge(storageSize)
+	return m
+}
+
+// routeName turns a route pattern into a metric name part, requests that
+// matched no route share one name.
+func routeName(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	name := strings.Trim(pattern, "/")
+	if name == "" {
+		return "root"
+	}
+	name = strings.NewReplacer("{", "", "}", "", "*", "any").Replace(name)
+	return strings.ReplaceAll(name, "/", "_")
+}
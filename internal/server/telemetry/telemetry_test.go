@@ -0,0 +1,49 @@
+package telemetry
+
+import (
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{pattern: "", want: "unmatched"},
+		{pattern: "/", want: "root"},
+		{pattern: "/updates/", want: "updates"},
+		{pattern: "/value/{type}/{name}", want: "value_type_name"},
+		{pattern: "/static/*", want: "static_any"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			assert.Equal(t, tt.want, routeName(tt.pattern))
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	before := Metrics(0)
+
+	Request("POST", "/updates/", 2*time.Second)
+	Ingested(metrics.TypeCounter, 3)
+	HashFailure()
+	Query(time.Second)
+	Retry()
+
+	m := Metrics(7)
+	assert.Equal(t, before.Counters["server_http_requests_POST_updates"]+1, m.Counters["server_http_requests_POST_updates"])
+	assert.InDelta(t, float64(before.Gauges["server_http_request_seconds_POST_updates"])+2, float64(m.Gauges["server_http_request_seconds_POST_updates"]), 1e-9)
+	assert.Equal(t, before.Counters["server_ingested_counter"]+3, m.Counters["server_ingested_counter"])
+	assert.Equal(t, before.Counters[HashFailures]+1, m.Counters[HashFailures])
+	assert.Equal(t, before.Counters[DBQueries]+1, m.Counters[DBQueries])
+	assert.Equal(t, before.Counters[DBRetries]+1, m.Counters[DBRetries])
+	assert.Equal(t, metrics.Gauge(7), m.Gauges[StorageSize])
+
+	// The result is a copy.
+	m.Counters[HashFailures] = 0
+	assert.NotZero(t, Metrics(0).Counters[HashFailures])
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opPut    = "put"
+	opBatch  = "batch"
+	opDelete = "delete"
+	opReset  = "reset"
+	opExpire = "expire"
+)
+
+// FileStorage keeps metrics in memory and durable in a file. Every change is
+// appended to a write-ahead log next to the file before it's acknowledged,
+// Snapshot writes the whole storage to the file and empties the log.
+type FileStorage struct {
+	mem *MemStorage
+
+	mu       sync.Mutex
+	filename string
+	wal      *os.File
+	seq      uint64
+}
+
+// record is a line of the write-ahead log.
+type record struct {
+	Seq      uint64                           `json:"seq"`
+	Time     time.Time                        `json:"time"`
+	Op       string                           `json:"op"`
+	ID       string                           `json:"id,omitempty"`
+	MType    string                           `json:"type,omitempty"`
+	Value    *float64                         `json:"value,omitempty"`
+	Delta    *int64                           `json:"delta,omitempty"`
+	Gauges   map[metrics.Name]metrics.Gauge   `json:"gauges,omitempty"`
+	Counters map[metrics.Name]metrics.Counter `json:"counters,omitempty"`
+	Before   *time.Time                       `json:"before,omitempty"`
+}
+
+// OpenFile opens the storage kept in filename and filename.wal. With restore
+// the snapshot is read and the log replayed over it, otherwise the storage
+// starts empty.
+func OpenFile(filename string, restore bool) (*FileStorage, error) {
+	f := &FileStorage{
+		mem:      New(),
+		filename: filename,
+	}
+
+	if restore {
+		if err := f.restore(); err != nil {
+			return nil, err
+		}
+	}
+
+	wal, err := os.OpenFile(f.walName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f.wal = wal
+
+	// The log may end with a record cut by a crash, nothing may follow it.
+	if err := f.Snapshot(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileStorage) walName() string {
+	return f.filename + ".wal"
+}
+
+func (f *FileStorage) restore() error {
+	data, err := os.ReadFile(f.filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, f.mem); err != nil {
+			return fmt.Errorf("could not restore %s - %w", f.filename, err)
+		}
+		var snapshot file
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return err
+		}
+		f.seq = snapshot.Seq
+	}
+
+	wal, err := os.Open(f.walName())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+
+	r := bufio.NewReader(wal)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("Write-ahead log %s is cut after record %d", f.walName(), f.seq)
+			return nil
+		}
+		// Records up to the snapshot are left when it's written right
+		// before a crash.
+		if rec.Seq <= f.seq {
+			continue
+		}
+		if err := f.apply(rec); err != nil {
+			log.Printf("Could not replay record %d: %v", rec.Seq, err)
+		}
+		f.seq = rec.Seq
+	}
+}
+
+func (f *FileStorage) apply(rec record) error {
+	switch rec.Op {
+	case opPut:
+		if rec.Value != nil {
+			return f.mem.put(rec.ID, metrics.Gauge(*rec.Value), rec.Time)
+		}
+		if rec.Delta != nil {
+			return f.mem.put(rec.ID, metrics.Counter(*rec.Delta), rec.Time)
+		}
+	case opBatch:
+		return f.mem.putMetrics(metrics.Metrics{Gauges: rec.Gauges, Counters: rec.Counters}, rec.Time)
+	case opDelete:
+		return f.mem.Delete(context.Background(), rec.MType, rec.ID)
+	case opReset:
+		return f.mem.resetCounter(rec.ID, rec.Time)
+	case opExpire:
+		if rec.Before != nil {
+			_, err := f.mem.expire(*rec.Before, rec.Time)
+			return err
+		}
+	}
+	return fmt.Errorf("unknown record %q", rec.Op)
+}
+
+// append writes a record to the log and waits until it's on disk.
+func (f *FileStorage) append(rec record) error {
+	rec.Seq = f.seq + 1
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := f.wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := f.wal.Sync(); err != nil {
+		return err
+	}
+	f.seq = rec.Seq
+	return nil
+}
+
+// commit writes a record to the log and then applies it to the memory. The
+// caller checks the record can be applied first, f.mu keeps the memory from
+// changing in between, so a record that's not on disk is never visible.
+func (f *FileStorage) commit(rec record) error {
+	if err := f.append(rec); err != nil {
+		return fmt.Errorf("could not write %s - %w", f.walName(), err)
+	}
+	return f.apply(rec)
+}
+
+func (f *FileStorage) Put(_ context.Context, key string, val interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.checkPut(key, val); err != nil {
+		return err
+	}
+
+	rec := record{Time: time.Now(), Op: opPut, ID: key, MType: TypeOf(val)}
+	switch m := val.(type) {
+	case metrics.Gauge:
+		value := float64(m)
+		rec.Value = &value
+	case metrics.Counter:
+		delta := int64(m)
+		rec.Delta = &delta
+	}
+	return f.commit(rec)
+}
+
+func (f *FileStorage) Get(ctx context.Context, key string) (interface{}, error) {
+	return f.mem.Get(ctx, key)
+}
+
+func (f *FileStorage) PutMetrics(_ context.Context, m metrics.Metrics) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.checkMetrics(m); err != nil {
+		return err
+	}
+	return f.commit(record{Time: time.Now(), Op: opBatch, Gauges: m.Gauges, Counters: m.Counters})
+}
+
+func (f *FileStorage) GetMetrics(ctx context.Context) (metrics.Metrics, error) {
+	return f.mem.GetMetrics(ctx)
+}
+
+func (f *FileStorage) Updated(ctx context.Context) (map[metrics.Name]time.Time, error) {
+	return f.mem.Updated(ctx)
+}
+
+func (f *FileStorage) UpdatedAt(ctx context.Context, key string) (time.Time, error) {
+	return f.mem.UpdatedAt(ctx, key)
+}
+
+func (f *FileStorage) Expire(_ context.Context, before time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rec := record{Time: time.Now(), Op: opExpire, Before: &before}
+	if err := f.append(rec); err != nil {
+		return 0, fmt.Errorf("could not write %s - %w", f.walName(), err)
+	}
+	return f.mem.expire(before, rec.Time)
+}
+
+func (f *FileStorage) Delete(_ context.Context, mtype, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.checkStored(mtype, key); err != nil {
+		return err
+	}
+	return f.commit(record{Time: time.Now(), Op: opDelete, ID: key, MType: mtype})
+}
+
+func (f *FileStorage) ResetCounter(_ context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.checkStored(metrics.TypeCounter, key); err != nil {
+		return err
+	}
+	return f.commit(record{Time: time.Now(), Op: opReset, ID: key})
+}
+
+// Snapshot writes the storage to the file and empties the log.
+func (f *FileStorage) Snapshot() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := f.mem.marshal(f.seq)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, data, "", "  "); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(f.filename, b.Bytes()); err != nil {
+		return err
+	}
+
+	if err := f.wal.Truncate(0); err != nil {
+		return err
+	}
+	return f.wal.Sync()
+}
+
+// Close writes the last snapshot.
+func (f *FileStorage) Close() error {
+	err := f.Snapshot()
+	if cerr := f.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file with data, a crash leaves either the old
+// or the new contents.
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,232 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/internal/storage/storagetest"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repositories {
+		s, err := storage.OpenFile(filepath.Join(t.TempDir(), "metrics.json"), true)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+// open opens the storage like the server does after a crash: without
+// closing the one that wrote the files.
+func open(t *testing.T, filename string) *storage.FileStorage {
+	s, err := storage.OpenFile(filename, true)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFileStorage_Restore(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := open(t, filename)
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(1)))
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(2)))
+	require.NoError(t, s.Snapshot())
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(3.5)))
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(5)))
+	require.NoError(t, s.PutMetrics(ctx, metrics.Metrics{
+		Counters: map[metrics.Name]metrics.Counter{"PollCount": 1, "Batched": 4},
+	}))
+	require.NoError(t, s.Put(ctx, "Removed", metrics.Gauge(1)))
+	require.NoError(t, s.Delete(ctx, metrics.TypeGauge, "Removed"))
+	require.NoError(t, s.Put(ctx, "Reset", metrics.Counter(9)))
+	require.NoError(t, s.ResetCounter(ctx, "Reset"))
+	updated, err := s.Updated(ctx)
+	require.NoError(t, err)
+
+	restored := open(t, filename)
+	mcs, err := restored.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 3.5}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 8, "Batched": 4, "Reset": 0}, mcs.Counters)
+
+	restoredUpdated, err := restored.Updated(ctx)
+	require.NoError(t, err)
+	require.Len(t, restoredUpdated, len(updated))
+	for k, u := range updated {
+		assert.True(t, u.Equal(restoredUpdated[k]), "%s updated at %v, restored %v", k, u, restoredUpdated[k])
+	}
+}
+
+func TestFileStorage_RestoreExpired(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := open(t, filename)
+	require.NoError(t, s.Put(ctx, "Old", metrics.Gauge(1)))
+	removed, err := s.Expire(ctx, time.Now().Add(time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.NoError(t, s.Put(ctx, "New", metrics.Gauge(2)))
+
+	mcs, err := open(t, filename).GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"New": 2}, mcs.Gauges)
+}
+
+func TestFileStorage_Crash(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		snapshot bool
+		crash    func(t *testing.T, filename string, wal []byte)
+		want     metrics.Counter
+	}{
+		{
+			name: "Log is cut",
+			crash: func(t *testing.T, filename string, wal []byte) {
+				require.NoError(t, os.WriteFile(filename+".wal", wal[:len(wal)-5], 0666))
+			},
+			want: 2,
+		},
+		{
+			name:     "Log is not emptied after the snapshot",
+			snapshot: true,
+			crash: func(t *testing.T, filename string, wal []byte) {
+				f, err := os.OpenFile(filename+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+				require.NoError(t, err)
+				defer f.Close()
+				_, err = f.Write(wal)
+				require.NoError(t, err)
+			},
+			want: 5,
+		},
+		{
+			name:     "Snapshot is cut",
+			snapshot: true,
+			crash: func(t *testing.T, filename string, wal []byte) {
+				tmp := filepath.Join(filepath.Dir(filename), "metrics.json.tmp123")
+				require.NoError(t, os.WriteFile(tmp, []byte(`{"Gauges":{"Al`), 0666))
+			},
+			want: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "metrics.json")
+
+			s := open(t, filename)
+			require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(2)))
+			require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(3)))
+			wal, err := os.ReadFile(filename + ".wal")
+			require.NoError(t, err)
+			if tt.snapshot {
+				require.NoError(t, s.Snapshot())
+			}
+
+			tt.crash(t, filename, wal)
+
+			val, err := open(t, filename).Get(ctx, "PollCount")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, val)
+		})
+	}
+}
+
+func TestFileStorage_NoRestore(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := open(t, filename)
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(2)))
+
+	fresh, err := storage.OpenFile(filename, false)
+	require.NoError(t, err)
+	defer fresh.Close()
+	_, err = fresh.Get(ctx, "PollCount")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Nothing from before is replayed later.
+	require.NoError(t, fresh.Put(ctx, "Other", metrics.Counter(1)))
+	mcs, err := open(t, filename).GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"Other": 1}, mcs.Counters)
+}
+
+func TestFileStorage_OldFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+	old := `{"Gauges":{"Alloc":1.5},"Counters":{"PollCount":3}}`
+	require.NoError(t, os.WriteFile(filename, []byte(old), 0666))
+
+	mcs, err := open(t, filename).GetMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 1.5}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 3}, mcs.Counters)
+}
+
+func TestFileStorage_WriteFails(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+
+	s, err := storage.OpenFile(filename, true)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(1)))
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(2)))
+	before, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+
+	// Nothing can be written to the log once it's closed.
+	require.NoError(t, s.Close())
+
+	assert.Error(t, s.Put(ctx, "Alloc", metrics.Gauge(5)))
+	assert.Error(t, s.Put(ctx, "PollCount", metrics.Counter(1)))
+	assert.Error(t, s.PutMetrics(ctx, metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{"New": 1},
+		Counters: map[metrics.Name]metrics.Counter{"PollCount": 1},
+	}))
+	assert.Error(t, s.Delete(ctx, metrics.TypeGauge, "Alloc"))
+	assert.Error(t, s.ResetCounter(ctx, "PollCount"))
+	_, err = s.Expire(ctx, time.Now().Add(time.Hour))
+	assert.Error(t, err)
+
+	after, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestFileStorage_BatchRecord(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := open(t, filename)
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(1)))
+	require.NoError(t, s.Snapshot())
+
+	require.NoError(t, s.PutMetrics(ctx, metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{"Frees": 2, "HeapIdle": 3},
+		Counters: map[metrics.Name]metrics.Counter{"PollCount": 4},
+	}))
+	// A conflicting batch is rejected before it's written.
+	assert.ErrorIs(t, s.PutMetrics(ctx, metrics.Metrics{
+		Gauges:   map[metrics.Name]metrics.Gauge{"Other": 5},
+		Counters: map[metrics.Name]metrics.Counter{"Alloc": 1},
+	}), storage.ErrTypeConflict)
+
+	wal, err := os.ReadFile(filename + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(wal, []byte("\n")))
+
+	mcs, err := open(t, filename).GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 1, "Frees": 2, "HeapIdle": 3}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 4}, mcs.Counters)
+}
@@ -3,9 +3,17 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Osselnet/metrics-collector/pkg/metrics"
-	"os"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("metric not found")
+	ErrTypeConflict = errors.New("metric type conflict")
 )
 
 type Repositories interface {
@@ -13,96 +21,443 @@ type Repositories interface {
 	Get(context.Context, string) (interface{}, error)
 	PutMetrics(context.Context, metrics.Metrics) error
 	GetMetrics(context.Context) (metrics.Metrics, error)
+	Updated(context.Context) (map[metrics.Name]time.Time, error)
+	UpdatedAt(ctx context.Context, key string) (time.Time, error)
+	Expire(context.Context, time.Time) (int, error)
+	Delete(ctx context.Context, mtype, key string) error
+	ResetCounter(ctx context.Context, key string) error
 }
 
+// shardCount is the number of independently locked parts of MemStorage.
+const shardCount = 32
+
+// MemStorage keeps metrics in shards by name, writes to metrics of
+// different shards don't wait for each other. Operations on several metrics
+// lock every shard.
 type MemStorage struct {
-	*metrics.Metrics
+	shards [shardCount]shard
+}
+
+type shard struct {
+	mu       sync.RWMutex
+	gauges   map[metrics.Name]metrics.Gauge
+	counters map[metrics.Name]metrics.Counter
+	updated  map[metrics.Name]time.Time
 }
 
 func New() *MemStorage {
-	return &MemStorage{
-		Metrics: metrics.New(),
+	s := &MemStorage{}
+	for i := range s.shards {
+		s.shards[i] = shard{
+			gauges:   make(map[metrics.Name]metrics.Gauge),
+			counters: make(map[metrics.Name]metrics.Counter),
+			updated:  make(map[metrics.Name]time.Time),
+		}
+	}
+	return s
+}
+
+// TypeConflict is the error for a write of mtype to a metric stored with
+// another type. The type of a metric is fixed by its first write until it's
+// deleted.
+func TypeConflict(key, stored, mtype string) error {
+	return fmt.Errorf("metric %s is a %s, not a %s - %w", key, stored, mtype, ErrTypeConflict)
+}
+
+// NotFound is the error for a read of a metric that isn't stored.
+func NotFound(key string) error {
+	return fmt.Errorf("%s - %w", key, ErrNotFound)
+}
+
+// TypeOf returns the metric type of a value, empty for unknown values.
+func TypeOf(val interface{}) string {
+	switch val.(type) {
+	case metrics.Gauge:
+		return metrics.TypeGauge
+	case metrics.Counter:
+		return metrics.TypeCounter
+	}
+	return ""
+}
+
+func (s *MemStorage) shard(key metrics.Name) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.shards[h.Sum32()%shardCount]
+}
+
+func (s *MemStorage) lock() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+}
+
+func (s *MemStorage) unlock() {
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+func (s *MemStorage) rlock() {
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+}
+
+func (s *MemStorage) runlock() {
+	for i := range s.shards {
+		s.shards[i].mu.RUnlock()
 	}
 }
 
 func (s *MemStorage) Put(_ context.Context, key string, val interface{}) error {
+	return s.put(key, val, time.Now())
+}
+
+func (s *MemStorage) put(key string, val interface{}, now time.Time) error {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := sh.checkPut(name, val); err != nil {
+		return err
+	}
 	switch m := val.(type) {
 	case metrics.Gauge:
-		s.Gauges[metrics.Name(key)] = m
+		sh.gauges[name] = m
 	case metrics.Counter:
-		_, ok := s.Counters[metrics.Name(key)]
-		if !ok {
-			s.Counters[metrics.Name(key)] = m
-		} else {
-			s.Counters[metrics.Name(key)] += m
-		}
-	default:
+		sh.counters[name] += m
+	}
+
+	sh.updated[name] = now
+	return nil
+}
+
+// checkPut returns the error put would return for the value without
+// storing it.
+func (s *MemStorage) checkPut(key string, val interface{}) error {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.checkPut(name, val)
+}
+
+func (sh *shard) checkPut(key metrics.Name, val interface{}) error {
+	mtype := TypeOf(val)
+	if mtype == "" {
 		return fmt.Errorf("metric not implemented")
 	}
+	return sh.check(key, mtype)
+}
 
+// check returns a type conflict when the metric is stored with another type
+// than mtype.
+func (sh *shard) check(key metrics.Name, mtype string) error {
+	if _, ok := sh.counters[key]; ok && mtype == metrics.TypeGauge {
+		return TypeConflict(string(key), metrics.TypeCounter, mtype)
+	}
+	if _, ok := sh.gauges[key]; ok && mtype == metrics.TypeCounter {
+		return TypeConflict(string(key), metrics.TypeGauge, mtype)
+	}
 	return nil
 }
 
 func (s *MemStorage) Get(_ context.Context, key string) (interface{}, error) {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
 
-	delta, ok := s.Counters[metrics.Name(key)]
+	delta, ok := sh.counters[name]
 	if ok {
 		return delta, nil
 	}
 
-	value, ok := s.Gauges[metrics.Name(key)]
+	value, ok := sh.gauges[name]
 	if ok {
 		return value, nil
 	}
 
-	return nil, fmt.Errorf("metric not implemented")
+	return nil, NotFound(key)
 }
 
+// PutMetrics puts a batch like Put does for each value, nothing is stored
+// when a value conflicts with the type of a metric.
 func (s *MemStorage) PutMetrics(_ context.Context, m metrics.Metrics) error {
-	if m.Gauges == nil {
-		m.Gauges = make(map[metrics.Name]metrics.Gauge)
-	}
+	return s.putMetrics(m, time.Now())
+}
 
-	if m.Counters == nil {
-		m.Counters = make(map[metrics.Name]metrics.Counter)
+func (s *MemStorage) putMetrics(m metrics.Metrics, now time.Time) error {
+	s.lock()
+	defer s.unlock()
+
+	if err := s.checkBatch(m); err != nil {
+		return err
 	}
+	for k, v := range m.Gauges {
+		sh := s.shard(k)
+		sh.gauges[k] = v
+		sh.updated[k] = now
+	}
+	for k, v := range m.Counters {
+		sh := s.shard(k)
+		sh.counters[k] += v
+		sh.updated[k] = now
+	}
+	return nil
+}
 
-	s.Metrics.Gauges = m.Gauges
-	s.Metrics.Counters = m.Counters
+// checkMetrics returns the error putMetrics would return for the batch
+// without storing it.
+func (s *MemStorage) checkMetrics(m metrics.Metrics) error {
+	s.rlock()
+	defer s.runlock()
+
+	return s.checkBatch(m)
+}
+
+func (s *MemStorage) checkBatch(m metrics.Metrics) error {
+	for k := range m.Gauges {
+		if err := s.shard(k).check(k, metrics.TypeGauge); err != nil {
+			return err
+		}
+	}
+	for k := range m.Counters {
+		if _, ok := m.Gauges[k]; ok {
+			return TypeConflict(string(k), metrics.TypeGauge, metrics.TypeCounter)
+		}
+		if err := s.shard(k).check(k, metrics.TypeCounter); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// GetMetrics returns a copy of all metrics as they were at a single moment.
 func (s *MemStorage) GetMetrics(_ context.Context) (metrics.Metrics, error) {
-	gauges := s.Metrics.Gauges
+	s.rlock()
+	defer s.runlock()
 
-	counters := s.Metrics.Counters
+	return s.metrics(), nil
+}
 
-	return metrics.Metrics{
-		Gauges:   gauges,
-		Counters: counters,
-	}, nil
+func (s *MemStorage) metrics() metrics.Metrics {
+	mcs := metrics.Metrics{
+		Gauges:   make(map[metrics.Name]metrics.Gauge),
+		Counters: make(map[metrics.Name]metrics.Counter),
+	}
+	for i := range s.shards {
+		for k, v := range s.shards[i].gauges {
+			mcs.Gauges[k] = v
+		}
+		for k, v := range s.shards[i].counters {
+			mcs.Counters[k] = v
+		}
+	}
+	return mcs
 }
 
-func (s *MemStorage) WriteDataToFile(filename string) error {
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
+// Updated returns the time every metric was last written.
+func (s *MemStorage) Updated(_ context.Context) (map[metrics.Name]time.Time, error) {
+	s.rlock()
+	defer s.runlock()
+
+	return s.updated(), nil
+}
+
+// UpdatedAt returns the time the metric was last written, zero for a
+// metric restored without a timestamp.
+func (s *MemStorage) UpdatedAt(_ context.Context, key string) (time.Time, error) {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	_, gauge := sh.gauges[name]
+	_, counter := sh.counters[name]
+	if !gauge && !counter {
+		return time.Time{}, NotFound(key)
+	}
+	return sh.updated[name], nil
+}
+
+func (s *MemStorage) updated() map[metrics.Name]time.Time {
+	updated := make(map[metrics.Name]time.Time)
+	for i := range s.shards {
+		for k, t := range s.shards[i].updated {
+			updated[k] = t
+		}
+	}
+	return updated
+}
+
+// Expire removes the metrics not written since before. Metrics restored
+// from a file without a timestamp are counted from the first call.
+func (s *MemStorage) Expire(_ context.Context, before time.Time) (int, error) {
+	return s.expire(before, time.Now())
+}
+
+func (s *MemStorage) expire(before, now time.Time) (int, error) {
+	removed := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for _, k := range sh.names() {
+			t, ok := sh.updated[k]
+			if !ok {
+				sh.updated[k] = now
+				continue
+			}
+			if t.Before(before) {
+				delete(sh.gauges, k)
+				delete(sh.counters, k)
+				delete(sh.updated, k)
+				removed++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return removed, nil
+}
+
+// Delete removes the metric of the type, ErrNotFound means there's no such
+// metric.
+func (s *MemStorage) Delete(_ context.Context, mtype, key string) error {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := sh.checkStored(name, mtype); err != nil {
 		return err
 	}
-	defer f.Close()
+	delete(sh.gauges, name)
+	delete(sh.counters, name)
+	delete(sh.updated, name)
+	return nil
+}
 
-	err = f.Truncate(0)
-	if err != nil {
+// checkStored returns ErrNotFound when there's no metric of the type, like
+// Delete and ResetCounter do.
+func (s *MemStorage) checkStored(mtype, key string) error {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	return sh.checkStored(name, mtype)
+}
+
+func (sh *shard) checkStored(key metrics.Name, mtype string) error {
+	switch mtype {
+	case metrics.TypeGauge:
+		if _, ok := sh.gauges[key]; !ok {
+			return ErrNotFound
+		}
+	case metrics.TypeCounter:
+		if _, ok := sh.counters[key]; !ok {
+			return ErrNotFound
+		}
+	default:
+		return fmt.Errorf("metric not implemented")
+	}
+	return nil
+}
+
+func (s *MemStorage) ResetCounter(_ context.Context, key string) error {
+	return s.resetCounter(key, time.Now())
+}
+
+func (s *MemStorage) resetCounter(key string, now time.Time) error {
+	name := metrics.Name(key)
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := sh.checkStored(name, metrics.TypeCounter); err != nil {
 		return err
 	}
+	sh.counters[name] = 0
+	sh.updated[name] = now
+	return nil
+}
 
-	data, err := json.MarshalIndent(s, "", "  ")
-	if err != nil {
+func (sh *shard) names() []metrics.Name {
+	names := make([]metrics.Name, 0, len(sh.gauges)+len(sh.counters))
+	for k := range sh.gauges {
+		names = append(names, k)
+	}
+	for k := range sh.counters {
+		names = append(names, k)
+	}
+	return names
+}
+
+// file is the format MemStorage is written to a file with. Seq is the last
+// write-ahead log record a FileStorage snapshot includes.
+type file struct {
+	Gauges    map[metrics.Name]metrics.Gauge
+	Counters  map[metrics.Name]metrics.Counter
+	UpdatedAt map[metrics.Name]time.Time `json:",omitempty"`
+	Seq       uint64                     `json:",omitempty"`
+}
+
+func (s *MemStorage) MarshalJSON() ([]byte, error) {
+	return s.marshal(0)
+}
+
+func (s *MemStorage) marshal(seq uint64) ([]byte, error) {
+	s.rlock()
+	mcs := s.metrics()
+	f := file{Gauges: mcs.Gauges, Counters: mcs.Counters, UpdatedAt: s.updated(), Seq: seq}
+	s.runlock()
+
+	return json.Marshal(f)
+}
+
+// UnmarshalJSON replaces the metrics with the ones read. A gauge with the
+// name of a counter, possible in files written before types were fixed, is
+// dropped.
+func (s *MemStorage) UnmarshalJSON(data []byte) error {
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
 		return err
 	}
 
-	_, err = f.Write(data)
+	s.lock()
+	defer s.unlock()
+
+	for i := range s.shards {
+		s.shards[i].gauges = make(map[metrics.Name]metrics.Gauge)
+		s.shards[i].counters = make(map[metrics.Name]metrics.Counter)
+		s.shards[i].updated = make(map[metrics.Name]time.Time)
+	}
+	for k, v := range f.Counters {
+		s.shard(k).counters[k] = v
+	}
+	for k, v := range f.Gauges {
+		if sh := s.shard(k); sh.check(k, metrics.TypeGauge) == nil {
+			sh.gauges[k] = v
+		}
+	}
+	for k, t := range f.UpdatedAt {
+		sh := s.shard(k)
+		if _, ok := sh.gauges[k]; ok {
+			sh.updated[k] = t
+		} else if _, ok := sh.counters[k]; ok {
+			sh.updated[k] = t
+		}
+	}
+	return nil
+}
+
+func (s *MemStorage) WriteDataToFile(filename string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeFileAtomic(filename, data)
 }
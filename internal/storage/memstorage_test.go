@@ -0,0 +1,101 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/internal/storage/storagetest"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repositories {
+		return storage.New()
+	})
+}
+
+// TestMemStorage_Load mixes every operation from many goroutines, it's
+// meant to be run with -race.
+func TestMemStorage_Load(t *testing.T) {
+	const (
+		workers = 16
+		writes  = 200
+	)
+	ctx := context.Background()
+	s := storage.New()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := metrics.Name(fmt.Sprintf("gauge%d", w))
+			for i := 0; i < writes; i++ {
+				assert.NoError(t, s.Put(ctx, "shared", metrics.Counter(1)))
+				assert.NoError(t, s.Put(ctx, string(own), metrics.Gauge(i)))
+				assert.NoError(t, s.PutMetrics(ctx, metrics.Metrics{
+					Counters: map[metrics.Name]metrics.Counter{"batched": 1},
+				}))
+
+				tmp := fmt.Sprintf("tmp%d_%d", w, i)
+				assert.NoError(t, s.Put(ctx, tmp, metrics.Counter(1)))
+				assert.NoError(t, s.ResetCounter(ctx, tmp))
+				assert.NoError(t, s.Delete(ctx, metrics.TypeCounter, tmp))
+
+				mcs, err := s.GetMetrics(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, metrics.Gauge(i), mcs.Gauges[own])
+				mcs.Counters["shared"] = -1
+
+				_, err = s.Updated(ctx)
+				assert.NoError(t, err)
+				_, err = s.Expire(ctx, time.Now().Add(-time.Hour))
+				assert.NoError(t, err)
+				_, err = json.Marshal(s)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	mcs, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(workers*writes), mcs.Counters["shared"])
+	assert.Equal(t, metrics.Counter(workers*writes), mcs.Counters["batched"])
+	assert.Len(t, mcs.Counters, 2)
+	assert.Len(t, mcs.Gauges, workers)
+}
+
+func TestMemStorage_JSON(t *testing.T) {
+	ctx := context.Background()
+	s := storage.New()
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(1.5)))
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(3)))
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	restored := storage.New()
+	require.NoError(t, json.Unmarshal(data, restored))
+
+	mcs, err := restored.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 1.5}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 3}, mcs.Counters)
+	updated, err := restored.Updated(ctx)
+	require.NoError(t, err)
+	assert.Len(t, updated, 2)
+
+	// Files written before types were fixed may have both.
+	old := `{"Gauges":{"x":1,"g":2},"Counters":{"x":3}}`
+	require.NoError(t, json.Unmarshal([]byte(old), restored))
+	mcs, err = restored.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"g": 2}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"x": 3}, mcs.Counters)
+}
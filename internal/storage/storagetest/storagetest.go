@@ -0,0 +1,308 @@
+// Package storagetest checks that a storage.Repositories implementation
+// behaves like the others. A backend runs it from its own tests:
+//
+//	storagetest.Run(t, func(t *testing.T) storage.Repositories {
+//		return newBackend()
+//	})
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/internal/storage"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run runs the conformance tests, newStorage returns an empty storage.
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	t.Run("put and get", func(t *testing.T) {
+		testPutGet(t, newStorage)
+	})
+	t.Run("accumulation", func(t *testing.T) {
+		testAccumulation(t, newStorage)
+	})
+	t.Run("batch", func(t *testing.T) {
+		testBatch(t, newStorage)
+	})
+	t.Run("not found", func(t *testing.T) {
+		testNotFound(t, newStorage)
+	})
+	t.Run("expiry", func(t *testing.T) {
+		testExpiry(t, newStorage)
+	})
+	t.Run("concurrency", func(t *testing.T) {
+		testConcurrency(t, newStorage)
+	})
+	t.Run("type conflicts", func(t *testing.T) {
+		testTypeConflicts(t, newStorage)
+	})
+}
+
+func testPutGet(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	require.NoError(t, s.Put(ctx, "Alloc", metrics.Gauge(1221.23)))
+	require.NoError(t, s.Put(ctx, "PollCount", metrics.Counter(42)))
+	require.Error(t, s.Put(ctx, "Other", 42))
+
+	val, err := s.Get(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(1221.23), val)
+	val, err = s.Get(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(42), val)
+
+	mcs, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[metrics.Name]metrics.Gauge{"Alloc": 1221.23}, mcs.Gauges)
+	assert.Equal(t, map[metrics.Name]metrics.Counter{"PollCount": 42}, mcs.Counters)
+}
+
+func testAccumulation(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	for _, v := range []metrics.Counter{1, 2, -4, 10} {
+		require.NoError(t, s.Put(ctx, "c", v))
+	}
+	for _, v := range []metrics.Gauge{1, -2.5, 0.125} {
+		require.NoError(t, s.Put(ctx, "g", v))
+	}
+
+	val, err := s.Get(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(9), val)
+	val, err = s.Get(ctx, "g")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(0.125), val)
+
+	require.NoError(t, s.ResetCounter(ctx, "c"))
+	require.NoError(t, s.Put(ctx, "c", metrics.Counter(3)))
+	val, err = s.Get(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(3), val)
+}
+
+func testBatch(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+
+	t.Run("like put", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Put(ctx, "c", metrics.Counter(2)))
+		require.NoError(t, s.Put(ctx, "g", metrics.Gauge(2)))
+		require.NoError(t, s.Put(ctx, "kept", metrics.Gauge(7)))
+
+		err := s.PutMetrics(ctx, metrics.Metrics{
+			Gauges:   map[metrics.Name]metrics.Gauge{"g": 3.5, "new": 1},
+			Counters: map[metrics.Name]metrics.Counter{"c": 5, "added": 1},
+		})
+		require.NoError(t, err)
+
+		mcs, err := s.GetMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[metrics.Name]metrics.Gauge{"g": 3.5, "new": 1, "kept": 7}, mcs.Gauges)
+		assert.Equal(t, map[metrics.Name]metrics.Counter{"c": 7, "added": 1}, mcs.Counters)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Put(ctx, "c", metrics.Counter(2)))
+		require.NoError(t, s.PutMetrics(ctx, metrics.Metrics{}))
+
+		val, err := s.Get(ctx, "c")
+		require.NoError(t, err)
+		assert.Equal(t, metrics.Counter(2), val)
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Put(ctx, "c", metrics.Counter(2)))
+
+		err := s.PutMetrics(ctx, metrics.Metrics{
+			Gauges:   map[metrics.Name]metrics.Gauge{"c": 1, "g": 1},
+			Counters: map[metrics.Name]metrics.Counter{"c": 1, "other": 1},
+		})
+		require.ErrorIs(t, err, storage.ErrTypeConflict)
+
+		mcs, err := s.GetMetrics(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, mcs.Gauges)
+		assert.Equal(t, map[metrics.Name]metrics.Counter{"c": 2}, mcs.Counters)
+	})
+}
+
+func testNotFound(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+	s := newStorage(t)
+	require.NoError(t, s.Put(ctx, "g", metrics.Gauge(1)))
+
+	_, err := s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.ErrorIs(t, s.Delete(ctx, metrics.TypeCounter, "missing"), storage.ErrNotFound)
+	assert.ErrorIs(t, s.Delete(ctx, metrics.TypeCounter, "g"), storage.ErrNotFound)
+	assert.ErrorIs(t, s.ResetCounter(ctx, "missing"), storage.ErrNotFound)
+	assert.ErrorIs(t, s.ResetCounter(ctx, "g"), storage.ErrNotFound)
+
+	require.NoError(t, s.Delete(ctx, metrics.TypeGauge, "g"))
+	_, err = s.Get(ctx, "g")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.ErrorIs(t, s.Delete(ctx, metrics.TypeGauge, "g"), storage.ErrNotFound)
+}
+
+func testExpiry(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+	s := newStorage(t)
+
+	start := time.Now().Add(-time.Second)
+	require.NoError(t, s.Put(ctx, "g", metrics.Gauge(1)))
+	require.NoError(t, s.Put(ctx, "c", metrics.Counter(1)))
+
+	updated, err := s.Updated(ctx)
+	require.NoError(t, err)
+	require.Len(t, updated, 2)
+	for k, u := range updated {
+		assert.True(t, u.After(start), "%s updated at %v", k, u)
+
+		at, err := s.UpdatedAt(ctx, string(k))
+		require.NoError(t, err)
+		assert.True(t, u.Equal(at), "%s updated at %v, looked up %v", k, u, at)
+	}
+	_, err = s.UpdatedAt(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	removed, err := s.Expire(ctx, start)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	removed, err = s.Expire(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	mcs, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mcs.Gauges)
+	assert.Empty(t, mcs.Counters)
+}
+
+func testConcurrency(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	const (
+		workers = 8
+		writes  = 50
+	)
+	ctx := context.Background()
+	s := newStorage(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*writes*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := fmt.Sprintf("g%d", w)
+			for i := 0; i < writes; i++ {
+				errs <- s.Put(ctx, "shared", metrics.Counter(1))
+				errs <- s.Put(ctx, own, metrics.Gauge(i))
+				_, err := s.Get(ctx, "shared")
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	mcs, err := s.GetMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(workers*writes), mcs.Counters["shared"])
+	assert.Len(t, mcs.Gauges, workers)
+	for w := 0; w < workers; w++ {
+		assert.Equal(t, metrics.Gauge(writes-1), mcs.Gauges[metrics.Name(fmt.Sprintf("g%d", w))])
+	}
+}
+
+func testTypeConflicts(t *testing.T, newStorage func(t *testing.T) storage.Repositories) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		first interface{}
+		then  interface{}
+	}{
+		{
+			name:  "counter over gauge",
+			first: metrics.Gauge(1.5),
+			then:  metrics.Counter(2),
+		},
+		{
+			name:  "gauge over counter",
+			first: metrics.Counter(2),
+			then:  metrics.Gauge(1.5),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage(t)
+			require.NoError(t, s.Put(ctx, "x", tt.first))
+
+			err := s.Put(ctx, "x", tt.then)
+			require.ErrorIs(t, err, storage.ErrTypeConflict)
+			assert.Contains(t, err.Error(), "metric x is a "+storage.TypeOf(tt.first))
+
+			val, err := s.Get(ctx, "x")
+			require.NoError(t, err)
+			assert.Equal(t, tt.first, val)
+
+			mcs, err := s.GetMetrics(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 1, len(mcs.Gauges)+len(mcs.Counters))
+		})
+
+		t.Run(tt.name+" after delete", func(t *testing.T) {
+			s := newStorage(t)
+			require.NoError(t, s.Put(ctx, "x", tt.first))
+			require.NoError(t, s.Delete(ctx, storage.TypeOf(tt.first), "x"))
+
+			require.NoError(t, s.Put(ctx, "x", tt.then))
+			val, err := s.Get(ctx, "x")
+			require.NoError(t, err)
+			assert.Equal(t, tt.then, val)
+		})
+	}
+
+	t.Run("same type", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Put(ctx, "c", metrics.Counter(2)))
+		require.NoError(t, s.Put(ctx, "c", metrics.Counter(3)))
+		require.NoError(t, s.Put(ctx, "g", metrics.Gauge(1)))
+		require.NoError(t, s.Put(ctx, "g", metrics.Gauge(2.5)))
+
+		val, err := s.Get(ctx, "c")
+		require.NoError(t, err)
+		assert.Equal(t, metrics.Counter(5), val)
+		val, err = s.Get(ctx, "g")
+		require.NoError(t, err)
+		assert.Equal(t, metrics.Gauge(2.5), val)
+	})
+
+	t.Run("batch with both types", func(t *testing.T) {
+		s := newStorage(t)
+		err := s.PutMetrics(ctx, metrics.Metrics{
+			Gauges:   map[metrics.Name]metrics.Gauge{"x": 1},
+			Counters: map[metrics.Name]metrics.Counter{"x": 1},
+		})
+		require.ErrorIs(t, err, storage.ErrTypeConflict)
+
+		mcs, err := s.GetMetrics(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, mcs.Gauges)
+		assert.Empty(t, mcs.Counters)
+	})
+}
@@ -0,0 +1,77 @@
+// Package agentconfig describes the settings the server hands out to agents
+// on GET /agent-config.
+package agentconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Collector names used in Settings.Collectors.
+const (
+	CollectorRuntime  = "runtime"
+	CollectorGopsutil = "gopsutil"
+	CollectorProcess  = "process"
+	CollectorCgroup   = "cgroup"
+	CollectorExec     = "exec"
+	CollectorScrape   = "scrape"
+	CollectorProbe    = "probe"
+)
+
+// Settings override the agent's own configuration. Zero values leave the
+// agent's value as is, a collector set to false is stopped.
+type Settings struct {
+	PollInterval   int             `json:"poll_interval,omitempty"`   // seconds
+	ReportInterval int             `json:"report_interval,omitempty"` // seconds
+	Collectors     map[string]bool `json:"collectors,omitempty"`
+}
+
+// File holds settings for all agents, for groups of agents and for single
+// agents by id. More specific settings override less specific ones field by
+// field.
+type File struct {
+	Default Settings            `json:"default"`
+	Groups  map[string]Settings `json:"groups"`
+	Agents  map[string]Settings `json:"agents"`
+}
+
+func Load(filename string) (*File, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("could not parse agent config %s - %w", filename, err)
+	}
+	return f, nil
+}
+
+func (f *File) Resolve(id, group string) Settings {
+	s := Settings{}
+	s.merge(f.Default)
+	if g, ok := f.Groups[group]; ok && group != "" {
+		s.merge(g)
+	}
+	if a, ok := f.Agents[id]; ok && id != "" {
+		s.merge(a)
+	}
+	return s
+}
+
+func (s *Settings) merge(src Settings) {
+	if src.PollInterval > 0 {
+		s.PollInterval = src.PollInterval
+	}
+	if src.ReportInterval > 0 {
+		s.ReportInterval = src.ReportInterval
+	}
+	for k, v := range src.Collectors {
+		if s.Collectors == nil {
+			s.Collectors = make(map[string]bool)
+		}
+		s.Collectors[k] = v
+	}
+}
@@ -0,0 +1,70 @@
+package agentconfig
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile_Resolve(t *testing.T) {
+	f := &File{
+		Default: Settings{PollInterval: 2, ReportInterval: 10},
+		Groups: map[string]Settings{
+			"web": {PollInterval: 5, Collectors: map[string]bool{CollectorProbe: true, CollectorExec: false}},
+		},
+		Agents: map[string]Settings{
+			"web-1": {ReportInterval: 30, Collectors: map[string]bool{CollectorExec: true}},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		id    string
+		group string
+		want  Settings
+	}{
+		{
+			name: "Default",
+			id:   "db-1",
+			want: Settings{PollInterval: 2, ReportInterval: 10},
+		},
+		{
+			name:  "Group",
+			id:    "web-2",
+			group: "web",
+			want:  Settings{PollInterval: 5, ReportInterval: 10, Collectors: map[string]bool{CollectorProbe: true, CollectorExec: false}},
+		},
+		{
+			name:  "Agent overrides group",
+			id:    "web-1",
+			group: "web",
+			want:  Settings{PollInterval: 5, ReportInterval: 30, Collectors: map[string]bool{CollectorProbe: true, CollectorExec: true}},
+		},
+		{
+			name:  "Unknown group",
+			id:    "web-2",
+			group: "db",
+			want:  Settings{PollInterval: 2, ReportInterval: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, f.Resolve(tt.id, tt.group))
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "agents.json")
+	require.NoError(t, os.WriteFile(filename, []byte(`{"default":{"poll_interval":3},"agents":{"web-1":{"collectors":{"exec":false}}}}`), 0644))
+
+	f, err := Load(filename)
+	require.NoError(t, err)
+	assert.Equal(t, Settings{PollInterval: 3, Collectors: map[string]bool{CollectorExec: false}}, f.Resolve("web-1", ""))
+
+	require.NoError(t, os.WriteFile(filename, []byte(`{"default":`), 0644))
+	_, err = Load(filename)
+	assert.Error(t, err)
+}
@@ -0,0 +1,282 @@
+// Package client lets applications report their own gauges and counters to
+// the metrics server.
+//
+//	c, err := client.Init(client.Config{Address: "localhost:8080"})
+//	...
+//	go c.Run(ctx)
+//	client.Counter("orders").Add(1)
+//	client.Gauge("queue").Set(42)
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-resty/resty/v2"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlushInterval = 10 * time.Second
+	defaultTimeout       = 4 * time.Second
+)
+
+type Config struct {
+	Address       string
+	Key           string
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+type Client struct {
+	cfg  Config
+	http *resty.Client
+
+	mu       sync.Mutex
+	gauges   map[metrics.Name]metrics.Gauge
+	counters map[metrics.Name]metrics.Counter
+}
+
+// A metric without a client belongs to the default one, it's looked up on
+// every update.
+type CounterMetric struct {
+	c    *Client
+	name metrics.Name
+}
+
+type GaugeMetric struct {
+	c    *Client
+	name metrics.Name
+}
+
+type metric struct {
+	ID    string   `json:"id"`
+	MType string   `json:"type"`
+	Delta *int64   `json:"delta,omitempty"`
+	Value *float64 `json:"value,omitempty"`
+	Hash  string   `json:"hash,omitempty"`
+}
+
+var (
+	stdMu sync.RWMutex
+	std   *Client
+)
+
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("you need to ask server address")
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	c := &Client{
+		cfg:      cfg,
+		http:     resty.New(),
+		gauges:   make(map[metrics.Name]metrics.Gauge),
+		counters: make(map[metrics.Name]metrics.Counter),
+	}
+	c.http.SetTimeout(cfg.Timeout)
+
+	return c, nil
+}
+
+// Init creates a client and makes it the default one used by the package
+// level Counter and Gauge functions.
+func Init(cfg Config) (*Client, error) {
+	c, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	stdMu.Lock()
+	std = c
+	stdMu.Unlock()
+
+	return c, nil
+}
+
+// Default returns the client set by Init, or nil if Init was not called.
+func Default() *Client {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+
+	return std
+}
+
+// Counter returns a counter of the default client. It may be created before
+// Init, updates made until Init is called are discarded.
+func Counter(name string) *CounterMetric {
+	return &CounterMetric{name: metrics.Name(name)}
+}
+
+// Gauge returns a gauge of the default client. It may be created before
+// Init, updates made until Init is called are discarded.
+func Gauge(name string) *GaugeMetric {
+	return &GaugeMetric{name: metrics.Name(name)}
+}
+
+func client(c *Client) *Client {
+	if c != nil {
+		return c
+	}
+	return Default()
+}
+
+func (c *Client) Counter(name string) *CounterMetric {
+	return &CounterMetric{c: c, name: metrics.Name(name)}
+}
+
+func (c *Client) Gauge(name string) *GaugeMetric {
+	return &GaugeMetric{c: c, name: metrics.Name(name)}
+}
+
+func (m *CounterMetric) Add(delta int64) {
+	c := client(m.c)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.counters[m.name] += metrics.Counter(delta)
+	c.mu.Unlock()
+}
+
+func (m *GaugeMetric) Set(value float64) {
+	c := client(m.c)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.gauges[m.name] = metrics.Gauge(value)
+	c.mu.Unlock()
+}
+
+// Run flushes buffered metrics every FlushInterval until ctx is done, then
+// makes a final flush.
+func (c *Client) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Println("client: flush failed -", err)
+			}
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+			if err := c.Flush(flushCtx); err != nil {
+				log.Println("client: final flush failed -", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Flush sends everything buffered so far in one batch. Metrics that could
+// not be sent are kept and merged with the ones collected meanwhile.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	mcs := metrics.Metrics{Gauges: c.gauges, Counters: c.counters}
+	c.gauges = make(map[metrics.Name]metrics.Gauge)
+	c.counters = make(map[metrics.Name]metrics.Counter)
+	c.mu.Unlock()
+
+	if len(mcs.Gauges) == 0 && len(mcs.Counters) == 0 {
+		return nil
+	}
+
+	err := c.send(ctx, c.batch(mcs))
+	if err != nil {
+		c.restore(mcs)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) restore(mcs metrics.Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, v := range mcs.Gauges {
+		if _, ok := c.gauges[k]; !ok {
+			c.gauges[k] = v
+		}
+	}
+	for k, v := range mcs.Counters {
+		c.counters[k] += v
+	}
+}
+
+func (c *Client) batch(mcs metrics.Metrics) []metric {
+	batch := make([]metric, 0, len(mcs.Gauges)+len(mcs.Counters))
+
+	for k, v := range mcs.Gauges {
+		value := float64(v)
+		m := metric{ID: string(k), MType: metrics.TypeGauge, Value: &value}
+		if c.cfg.Key != "" {
+			m.Hash = metrics.GaugeHash(c.cfg.Key, m.ID, value)
+		}
+		batch = append(batch, m)
+	}
+
+	for k, v := range mcs.Counters {
+		delta := int64(v)
+		m := metric{ID: string(k), MType: metrics.TypeCounter, Delta: &delta}
+		if c.cfg.Key != "" {
+			m.Hash = metrics.CounterHash(c.cfg.Key, m.ID, delta)
+		}
+		batch = append(batch, m)
+	}
+	return batch
+}
+
+func (c *Client) send(ctx context.Context, batch []metric) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	data, err = compress(data)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip").
+		SetHeader("Accept-Encoding", "gzip").
+		SetBody(data).
+		Post(fmt.Sprintf("http://%s/updates/", c.cfg.Address))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("invalid status code %v", resp.StatusCode())
+	}
+	return nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed write data to compress temporary buffer: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed compress data: %v", err)
+	}
+	return b.Bytes(), nil
+}
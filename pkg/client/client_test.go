@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"github.com/Osselnet/metrics-collector/internal/server/handlers"
+	"github.com/Osselnet/metrics-collector/pkg/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClient_Flush(t *testing.T) {
+	h := handlers.New(chi.NewRouter(), nil, "", false, "secret")
+	server := httptest.NewServer(h.GetRouter())
+	defer server.Close()
+
+	c, err := New(Config{Address: strings.TrimPrefix(server.URL, "http://"), Key: "secret"})
+	require.NoError(t, err)
+
+	c.Counter("orders").Add(1)
+	c.Counter("orders").Add(2)
+	c.Gauge("queue").Set(1.5)
+	c.Gauge("queue").Set(4.25)
+
+	require.NoError(t, c.Flush(context.Background()))
+
+	orders, err := h.Storage.Get(context.Background(), "orders")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(3), orders)
+
+	queue, err := h.Storage.Get(context.Background(), "queue")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(4.25), queue)
+
+	c.Counter("orders").Add(1)
+	require.NoError(t, c.Flush(context.Background()))
+
+	orders, err = h.Storage.Get(context.Background(), "orders")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(4), orders)
+}
+
+func TestClient_FlushFailureKeepsMetrics(t *testing.T) {
+	server := httptest.NewServer(nil)
+	address := strings.TrimPrefix(server.URL, "http://")
+	server.Close()
+
+	c, err := New(Config{Address: address})
+	require.NoError(t, err)
+
+	c.Counter("orders").Add(5)
+	require.Error(t, c.Flush(context.Background()))
+
+	c.Counter("orders").Add(1)
+	assert.Equal(t, metrics.Counter(6), c.counters["orders"])
+}
+
+// Created like a package level variable, before Init.
+var defaultOrders = Counter("orders")
+
+func TestDefault(t *testing.T) {
+	assert.NotPanics(t, func() {
+		defaultOrders.Add(1)
+		Gauge("queue").Set(1)
+	})
+
+	c, err := Init(Config{Address: "localhost:8080"})
+	require.NoError(t, err)
+	assert.Same(t, c, Default())
+
+	defaultOrders.Add(2)
+	Counter("orders").Add(3)
+	Gauge("queue").Set(4)
+	assert.Equal(t, metrics.Counter(5), c.counters["orders"])
+	assert.Equal(t, metrics.Gauge(4), c.gauges["queue"])
+}
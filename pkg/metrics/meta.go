@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	UnitBytes        = "bytes"
+	UnitNanoseconds  = "ns"
+	UnitMicroseconds = "us"
+	UnitSeconds      = "s"
+	UnitPercent      = "percent"
+	UnitRatio        = "ratio"
+)
+
+// Meta describes a metric: the type its values are sent with, the unit and
+// a help text.
+type Meta struct {
+	Type string `json:"type"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+}
+
+var builtin = map[Name]Meta{
+	Alloc:         {TypeGauge, UnitBytes, "Bytes of allocated heap objects"},
+	TotalAlloc:    {TypeGauge, UnitBytes, "Cumulative bytes allocated for heap objects"},
+	Sys:           {TypeGauge, UnitBytes, "Total bytes of memory obtained from the OS"},
+	Lookups:       {TypeGauge, "", "Number of pointer lookups performed by the runtime"},
+	Mallocs:       {TypeGauge, "", "Cumulative count of heap objects allocated"},
+	Frees:         {TypeGauge, "", "Cumulative count of heap objects freed"},
+	HeapAlloc:     {TypeGauge, UnitBytes, "Bytes of allocated heap objects"},
+	HeapSys:       {TypeGauge, UnitBytes, "Bytes of heap memory obtained from the OS"},
+	HeapIdle:      {TypeGauge, UnitBytes, "Bytes in idle heap spans"},
+	HeapInuse:     {TypeGauge, UnitBytes, "Bytes in in-use heap spans"},
+	HeapReleased:  {TypeGauge, UnitBytes, "Bytes of physical memory returned to the OS"},
+	HeapObjects:   {TypeGauge, "", "Number of allocated heap objects"},
+	StackInuse:    {TypeGauge, UnitBytes, "Bytes in stack spans"},
+	StackSys:      {TypeGauge, UnitBytes, "Bytes of stack memory obtained from the OS"},
+	MSpanInuse:    {TypeGauge, UnitBytes, "Bytes of allocated mspan structures"},
+	MSpanSys:      {TypeGauge, UnitBytes, "Bytes of memory obtained from the OS for mspan structures"},
+	MCacheInuse:   {TypeGauge, UnitBytes, "Bytes of allocated mcache structures"},
+	MCacheSys:     {TypeGauge, UnitBytes, "Bytes of memory obtained from the OS for mcache structures"},
+	BuckHashSys:   {TypeGauge, UnitBytes, "Bytes of memory in profiling bucket hash tables"},
+	GCSys:         {TypeGauge, UnitBytes, "Bytes of memory in garbage collection metadata"},
+	OtherSys:      {TypeGauge, UnitBytes, "Bytes of memory in miscellaneous off-heap runtime allocations"},
+	NextGC:        {TypeGauge, UnitBytes, "Target heap size of the next GC cycle"},
+	LastGC:        {TypeGauge, UnitNanoseconds, "Time the last GC finished, since the Unix epoch"},
+	PauseTotalNs:  {TypeGauge, UnitNanoseconds, "Cumulative time in GC stop-the-world pauses"},
+	GCCPUFraction: {TypeGauge, UnitRatio, "Fraction of CPU time used by the GC since the program started"},
+	NumForcedGC:   {TypeGauge, "", "Number of GC cycles forced by the application"},
+	NumGC:         {TypeGauge, "", "Number of completed GC cycles"},
+	RandomValue:   {TypeGauge, "", "Random value in [0, 1)"},
+	TotalMemory:   {TypeGauge, UnitBytes, "Total physical memory"},
+	FreeMemory:    {TypeGauge, UnitBytes, "Free physical memory"},
+	SwapTotal:     {TypeGauge, UnitBytes, "Total swap space"},
+	SwapUsed:      {TypeGauge, UnitBytes, "Used swap space"},
+	SwapFree:      {TypeGauge, UnitBytes, "Free swap space"},
+	Load1:         {TypeGauge, "", "System load average over 1 minute"},
+	Load5:         {TypeGauge, "", "System load average over 5 minutes"},
+	Load15:        {TypeGauge, "", "System load average over 15 minutes"},
+	Uptime:        {TypeGauge, UnitSeconds, "Time since the host booted"},
+
+	AgentBatchesSent:   {TypeCounter, "", "Batches delivered by the agent"},
+	AgentBatchesFailed: {TypeCounter, "", "Batches the agent failed to deliver"},
+	AgentBatchesLost:   {TypeCounter, "", "Undelivered batches the agent could not queue"},
+	AgentRetries:       {TypeCounter, "", "Send retries made by the agent"},
+	AgentBytesRaw:      {TypeCounter, UnitBytes, "Bytes of reports before compression"},
+	AgentBytesSent:     {TypeCounter, UnitBytes, "Bytes of reports after compression"},
+	AgentSendLatency:   {TypeGauge, UnitSeconds, "Average request latency during the last report interval"},
+	AgentQueueDepth:    {TypeGauge, "", "Snapshots waiting to be aggregated"},
+
+	PollCount: {TypeCounter, "", "Number of runtime metrics polls"},
+}
+
+// families are reported per device, process or label as "<name>_<label>".
+var families = map[Name]Meta{
+	"CPUutilization": {TypeGauge, UnitPercent, "CPU utilization of a core"},
+
+	DiskTotal:       {TypeGauge, UnitBytes, "Total space of a filesystem"},
+	DiskUsed:        {TypeGauge, UnitBytes, "Used space of a filesystem"},
+	DiskFree:        {TypeGauge, UnitBytes, "Free space of a filesystem"},
+	DiskUsedPercent: {TypeGauge, UnitPercent, "Used space of a filesystem"},
+	DiskReadBytes:   {TypeCounter, UnitBytes, "Bytes read from a disk"},
+	DiskWriteBytes:  {TypeCounter, UnitBytes, "Bytes written to a disk"},
+	DiskReadCount:   {TypeCounter, "", "Reads from a disk"},
+	DiskWriteCount:  {TypeCounter, "", "Writes to a disk"},
+	NetBytesSent:    {TypeCounter, UnitBytes, "Bytes sent by a network interface"},
+	NetBytesRecv:    {TypeCounter, UnitBytes, "Bytes received by a network interface"},
+	NetPacketsSent:  {TypeCounter, "", "Packets sent by a network interface"},
+	NetPacketsRecv:  {TypeCounter, "", "Packets received by a network interface"},
+	NetErrIn:        {TypeCounter, "", "Receive errors of a network interface"},
+	NetErrOut:       {TypeCounter, "", "Send errors of a network interface"},
+
+	ProcessCount:    {TypeGauge, "", "Number of running processes of a watch"},
+	ProcessCPU:      {TypeGauge, UnitPercent, "CPU usage of the processes of a watch"},
+	ProcessRSS:      {TypeGauge, UnitBytes, "Resident memory of the processes of a watch"},
+	ProcessFDs:      {TypeGauge, "", "Open file descriptors of the processes of a watch"},
+	ProcessThreads:  {TypeGauge, "", "Threads of the processes of a watch"},
+	ProcessRestarts: {TypeCounter, "", "Restarts of the processes of a watch"},
+
+	CgroupMemoryCurrent:    {TypeGauge, UnitBytes, "Memory used by a cgroup"},
+	CgroupMemoryMax:        {TypeGauge, UnitBytes, "Memory limit of a cgroup"},
+	CgroupPids:             {TypeGauge, "", "Number of processes in a cgroup"},
+	CgroupCPUUsage:         {TypeCounter, UnitMicroseconds, "CPU time used by a cgroup"},
+	CgroupCPUUser:          {TypeCounter, UnitMicroseconds, "User CPU time used by a cgroup"},
+	CgroupCPUSystem:        {TypeCounter, UnitMicroseconds, "System CPU time used by a cgroup"},
+	CgroupCPUThrottled:     {TypeCounter, "", "Periods a cgroup was throttled"},
+	CgroupCPUThrottledTime: {TypeCounter, UnitMicroseconds, "Time a cgroup was throttled"},
+	CgroupIOReadBytes:      {TypeCounter, UnitBytes, "Bytes read by a cgroup"},
+	CgroupIOWriteBytes:     {TypeCounter, UnitBytes, "Bytes written by a cgroup"},
+	CgroupIOReads:          {TypeCounter, "", "Read operations of a cgroup"},
+	CgroupIOWrites:         {TypeCounter, "", "Write operations of a cgroup"},
+
+	ProbeSuccess:        {TypeGauge, "", "1 if the last probe succeeded, 0 otherwise"},
+	ProbeFailures:       {TypeCounter, "", "Failed probes"},
+	ProbeHTTPDuration:   {TypeGauge, UnitSeconds, "Duration of the last HTTP probe"},
+	ProbeHTTPStatusCode: {TypeGauge, "", "Status code of the last HTTP probe"},
+	ProbeTCPDuration:    {TypeGauge, UnitSeconds, "Duration of the last TCP probe"},
+	ProbeDNSDuration:    {TypeGauge, UnitSeconds, "Duration of the last DNS probe"},
+}
+
+// Describe returns the metadata of a built-in metric. Per-device metrics are
+// matched by their family, e.g. DiskUsed_root by DiskUsed and
+// CPUutilization3 by CPUutilization.
+func Describe(name Name) (Meta, bool) {
+	if m, ok := builtin[name]; ok {
+		return m, true
+	}
+
+	family, _, ok := strings.Cut(string(name), "_")
+	if !ok {
+		family = strings.TrimRight(family, "0123456789")
+	}
+	m, ok := families[Name(family)]
+	return m, ok
+}
+
+// Registry keeps metadata set at run time, built-in metadata is used for
+// the names it doesn't know.
+type Registry struct {
+	mu   sync.RWMutex
+	meta map[Name]Meta
+}
+
+func NewRegistry() *Registry {
+	return &Registry{meta: make(map[Name]Meta)}
+}
+
+func (r *Registry) Set(name Name, m Meta) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.meta[name] = m
+}
+
+func (r *Registry) Get(name Name) (Meta, bool) {
+	r.mu.RLock()
+	m, ok := r.meta[name]
+	r.mu.RUnlock()
+	if ok {
+		return m, true
+	}
+	return Describe(name)
+}
+
+// All returns a copy of the metadata set at run time.
+func (r *Registry) All() map[Name]Meta {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make(map[Name]Meta, len(r.meta))
+	for k, m := range r.meta {
+		all[k] = m
+	}
+	return all
+}
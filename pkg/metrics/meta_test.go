@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name Name
+		want Meta
+		ok   bool
+	}{
+		{name: HeapAlloc, want: Meta{TypeGauge, UnitBytes, "Bytes of allocated heap objects"}, ok: true},
+		{name: PollCount, want: Meta{TypeCounter, "", "Number of runtime metrics polls"}, ok: true},
+		{name: "DiskUsed_var_lib", want: Meta{TypeGauge, UnitBytes, "Used space of a filesystem"}, ok: true},
+		{name: "NetBytesSent_eth0", want: Meta{TypeCounter, UnitBytes, "Bytes sent by a network interface"}, ok: true},
+		{name: "CPUutilization3", want: Meta{TypeGauge, UnitPercent, "CPU utilization of a core"}, ok: true},
+		{name: "Alloc_custom"},
+		{name: "Unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			got, ok := Describe(tt.name)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	_, ok := r.Get("QueueSize")
+	assert.False(t, ok)
+
+	r.Set("QueueSize", Meta{Type: TypeGauge, Help: "Jobs waiting"})
+	r.Set(Alloc, Meta{Type: TypeGauge, Unit: "KiB"})
+
+	m, ok := r.Get("QueueSize")
+	assert.True(t, ok)
+	assert.Equal(t, "Jobs waiting", m.Help)
+
+	// Metadata set at run time takes precedence over the built-in one.
+	m, _ = r.Get(Alloc)
+	assert.Equal(t, "KiB", m.Unit)
+
+	m, _ = r.Get(HeapAlloc)
+	assert.Equal(t, UnitBytes, m.Unit)
+
+	assert.Len(t, r.All(), 2)
+}
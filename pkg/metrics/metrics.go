@@ -45,6 +45,64 @@ const (
 	RandomValue   = Name("RandomValue")
 	TotalMemory   = Name("TotalMemory")
 	FreeMemory    = Name("FreeMemory")
+	SwapTotal     = Name("SwapTotal")
+	SwapUsed      = Name("SwapUsed")
+	SwapFree      = Name("SwapFree")
+	Load1         = Name("Load1")
+	Load5         = Name("Load5")
+	Load15        = Name("Load15")
+	Uptime        = Name("Uptime")
+
+	DiskTotal       = Name("DiskTotal")
+	DiskUsed        = Name("DiskUsed")
+	DiskFree        = Name("DiskFree")
+	DiskUsedPercent = Name("DiskUsedPercent")
+	DiskReadBytes   = Name("DiskReadBytes")
+	DiskWriteBytes  = Name("DiskWriteBytes")
+	DiskReadCount   = Name("DiskReadCount")
+	DiskWriteCount  = Name("DiskWriteCount")
+	NetBytesSent    = Name("NetBytesSent")
+	NetBytesRecv    = Name("NetBytesRecv")
+	NetPacketsSent  = Name("NetPacketsSent")
+	NetPacketsRecv  = Name("NetPacketsRecv")
+	NetErrIn        = Name("NetErrIn")
+	NetErrOut       = Name("NetErrOut")
+
+	ProcessCount    = Name("ProcessCount")
+	ProcessCPU      = Name("ProcessCPU")
+	ProcessRSS      = Name("ProcessRSS")
+	ProcessFDs      = Name("ProcessFDs")
+	ProcessThreads  = Name("ProcessThreads")
+	ProcessRestarts = Name("ProcessRestarts")
+
+	CgroupMemoryCurrent    = Name("CgroupMemoryCurrent")
+	CgroupMemoryMax        = Name("CgroupMemoryMax")
+	CgroupPids             = Name("CgroupPids")
+	CgroupCPUUsage         = Name("CgroupCPUUsage")
+	CgroupCPUUser          = Name("CgroupCPUUser")
+	CgroupCPUSystem        = Name("CgroupCPUSystem")
+	CgroupCPUThrottled     = Name("CgroupCPUThrottled")
+	CgroupCPUThrottledTime = Name("CgroupCPUThrottledTime")
+	CgroupIOReadBytes      = Name("CgroupIOReadBytes")
+	CgroupIOWriteBytes     = Name("CgroupIOWriteBytes")
+	CgroupIOReads          = Name("CgroupIOReads")
+	CgroupIOWrites         = Name("CgroupIOWrites")
+
+	ProbeSuccess        = Name("ProbeSuccess")
+	ProbeFailures       = Name("ProbeFailures")
+	ProbeHTTPDuration   = Name("ProbeHTTPDuration")
+	ProbeHTTPStatusCode = Name("ProbeHTTPStatusCode")
+	ProbeTCPDuration    = Name("ProbeTCPDuration")
+	ProbeDNSDuration    = Name("ProbeDNSDuration")
+
+	AgentBatchesSent   = Name("AgentBatchesSent")
+	AgentBatchesFailed = Name("AgentBatchesFailed")
+	AgentBatchesLost   = Name("AgentBatchesLost")
+	AgentRetries       = Name("AgentRetries")
+	AgentBytesRaw      = Name("AgentBytesRaw")
+	AgentBytesSent     = Name("AgentBytesSent")
+	AgentSendLatency   = Name("AgentSendLatency")
+	AgentQueueDepth    = Name("AgentQueueDepth")
 
 	PollCount = Name("PollCount")
 )
@@ -67,6 +125,23 @@ func New() *Metrics {
 	}
 }
 
+// Merge adds src to m: counters are summed, gauges take the value from src.
+func (m *Metrics) Merge(src Metrics) {
+	if m.Gauges == nil {
+		m.Gauges = make(map[Name]Gauge, len(src.Gauges))
+	}
+	if m.Counters == nil {
+		m.Counters = make(map[Name]Counter, len(src.Counters))
+	}
+
+	for k, v := range src.Gauges {
+		m.Gauges[k] = v
+	}
+	for k, v := range src.Counters {
+		m.Counters[k] += v
+	}
+}
+
 func (g *Gauge) FromString(str string) error {
 	val, err := strconv.ParseFloat(str, 64)
 	if err != nil {